@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/relay"
+)
+
+// loadCommandConfig parses the flags shared by the configuration related
+// subcommands and loads the configuration file
+func loadCommandConfig(fs *flag.FlagSet, args []string) config.Config {
+	cfgFile := fs.String("config", "", "Configuration file to use")
+	cfgFormat := fs.String("config-format", "", "Format of the configuration file (toml, yaml or json)")
+	cfgDir := fs.String("config-dir", "", "Directory of configuration fragments")
+	_ = fs.Parse(args)
+
+	if *cfgFile == "" && *cfgDir == "" {
+		fmt.Fprintln(os.Stderr, "Missing configuration file")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	cfg, err := config.LoadConfig(*cfgFile, *cfgFormat, *cfgDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	return cfg
+}
+
+// runCheck implements the check subcommand, which reports
+// every semantic problem of a configuration file
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+
+	// Loading the configuration performs the whole validation
+	_ = loadCommandConfig(fs, args)
+
+	fmt.Println("configuration is valid")
+}
+
+// runDump implements the dump subcommand, which prints
+// the configuration with all the default values filled in
+func runDump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := fs.String("format", config.FormatTOML, "Output format (toml, yaml or json)")
+	cfg := loadCommandConfig(fs, args)
+	cfg.SetDefaults()
+
+	data, err := cfg.Encode(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	_, _ = os.Stdout.Write(data)
+}
+
+// runRoute implements the route subcommand, which reads line protocol
+// on stdin and prints the outputs each point would be forwarded to
+func runRoute(args []string) {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	precision := fs.String("precision", "n", "Precision of the timestamps read on stdin")
+	cfg := loadCommandConfig(fs, args)
+
+	router := relay.NewRouter(cfg)
+	now := time.Now()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		points, err := models.ParsePointsWithPrecision([]byte(line), now, *precision)
+		if err != nil {
+			fmt.Printf("%s\n  invalid point: %v\n", line, err)
+			continue
+		}
+
+		for _, p := range points {
+			fmt.Println(p.PrecisionString(*precision))
+			for _, r := range router.Route(p) {
+				outputs := "(none)"
+				if len(r.Outputs) > 0 {
+					outputs = strings.Join(r.Outputs, ", ")
+				}
+				fmt.Printf("  %s %q: %s\n", r.Kind, r.Relay, outputs)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
@@ -1,44 +1,176 @@
 package config
 
 import (
-	"os"
 	"regexp"
-
-	"github.com/naoina/toml"
+	"strings"
 )
 
 // Config is an object created from a configuration file
 // It is a list of HTTP and/or UDP relays
 // Each relay has its own list of backends
 type Config struct {
-	HTTPRelays []HTTPConfig `toml:"http"`
-	UDPRelays  []UDPConfig  `toml:"udp"`
-	Filters    Filters      `toml:"filter"`
-	Verbose    bool
+	// Include lists files to merge into this configuration
+	// Glob patterns are allowed, relative paths start from the including file
+	Include []string `toml:"include,omitempty" yaml:"include,omitempty" json:"include,omitempty"`
+
+	HTTPRelays []HTTPConfig  `toml:"http" yaml:"http" json:"http"`
+	UDPRelays  []UDPConfig   `toml:"udp" yaml:"udp" json:"udp"`
+	Filters    Filters       `toml:"filter" yaml:"filter" json:"filter"`
+	Metrics    MetricsConfig `toml:"metrics" yaml:"metrics" json:"metrics"`
+	Monitor    MonitorConfig `toml:"monitor" yaml:"monitor" json:"monitor"`
+	Tracing    TracingConfig `toml:"tracing" yaml:"tracing" json:"tracing"`
+	Log        LogConfig     `toml:"log" yaml:"log" json:"log"`
+	Verbose    bool          `toml:"-" yaml:"-" json:"-"`
+}
+
+// MonitorConfig represents the self-monitoring of the relay, which
+// periodically writes its internal statistics into an HTTP output
+type MonitorConfig struct {
+	// Enabled starts the self-monitoring (default: false)
+	Enabled bool `toml:"enabled" yaml:"enabled" json:"enabled"`
+
+	// Interval between two writes of the statistics (default: 10s)
+	// The format used is the same seen in time.ParseDuration
+	Interval string `toml:"interval" yaml:"interval" json:"interval"`
+
+	// Output is the name of the HTTP output the statistics are written to
+	Output string `toml:"output" yaml:"output" json:"output"`
+
+	// Database the statistics are written to (default: _relay)
+	Database string `toml:"database" yaml:"database" json:"database"`
+
+	// RetentionPolicy the statistics are written to, if set
+	RetentionPolicy string `toml:"retention-policy" yaml:"retention-policy" json:"retention-policy"`
+}
+
+// MetricsConfig represents the server exposing the Prometheus metrics
+type MetricsConfig struct {
+	// Enabled can be set to false in order not to expose any metric (default: true)
+	Enabled *bool `toml:"enabled,omitempty" yaml:"enabled,omitempty" json:"enabled,omitempty"`
+
+	// Addr is the listening host:port of the metrics server (default: :8088)
+	Addr string `toml:"bind-addr" yaml:"bind-addr" json:"bind-addr"`
+
+	// Path is the route serving the metrics (default: /metrics)
+	Path string `toml:"path" yaml:"path" json:"path"`
+
+	// Set certificate in order to serve the metrics over HTTPS
+	SSLCombinedPem string `toml:"ssl-combined-pem" yaml:"ssl-combined-pem" json:"ssl-combined-pem"`
+
+	// RelayListeners serves the metrics on the listener of each HTTP relay
+	// instead of a dedicated server
+	RelayListeners bool `toml:"relay-listeners" yaml:"relay-listeners" json:"relay-listeners"`
+}
+
+// IsEnabled tells whether the metrics have to be exposed
+func (m MetricsConfig) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// AddrOrDefault returns the address of the metrics server
+func (m MetricsConfig) AddrOrDefault() string {
+	if m.Addr == "" {
+		return DefaultMetricsAddr
+	}
+
+	return m.Addr
+}
+
+// PathOrDefault returns the route serving the metrics
+func (m MetricsConfig) PathOrDefault() string {
+	if m.Path == "" {
+		return DefaultMetricsPath
+	}
+
+	return m.Path
+}
+
+// Supported log levels, formats and outputs
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+
+	LogLogfmt = "logfmt"
+	LogJSON   = "json"
+
+	LogStdout = "stdout"
+	LogStderr = "stderr"
+)
+
+// LogConfig represents the logs of the relay
+type LogConfig struct {
+	// Level is the minimum level of the messages: debug, info, warn or error
+	// (default: info, debug with the -v flag)
+	Level string `toml:"level" yaml:"level" json:"level"`
+
+	// Format of the messages: logfmt or json (default: logfmt)
+	Format string `toml:"format" yaml:"format" json:"format"`
+
+	// Output is stdout, stderr or the path of a file (default: stderr)
+	Output string `toml:"output" yaml:"output" json:"output"`
+
+	// SampleFirst is the number of identical warnings and errors written during
+	// each sample interval, the next ones are dropped (default: 0, no sampling)
+	SampleFirst int `toml:"sample-first" yaml:"sample-first" json:"sample-first"`
+
+	// SampleInterval is the period of the sampling (default: 1s)
+	SampleInterval string `toml:"sample-interval" yaml:"sample-interval" json:"sample-interval"`
+}
+
+// Supported trace exporters
+const (
+	TracingOTLP   = "otlp"
+	TracingFile   = "file"
+	TracingStdout = "stdout"
+)
+
+// TracingConfig represents the export of the traces of the writes
+type TracingConfig struct {
+	// Exporter is where the spans are sent: otlp, file or stdout
+	// Tracing is disabled when it is not set
+	Exporter string `toml:"exporter" yaml:"exporter" json:"exporter"`
+
+	// Endpoint is the URL of the OTLP/HTTP collector
+	// (default: http://localhost:4318/v1/traces)
+	Endpoint string `toml:"endpoint" yaml:"endpoint" json:"endpoint"`
+
+	// Headers are added to the requests sent to the OTLP collector
+	Headers map[string]string `toml:"headers,omitempty" yaml:"headers,omitempty" json:"headers,omitempty"`
+
+	// File the spans are written to by the file exporter
+	File string `toml:"file" yaml:"file" json:"file"`
+
+	// SampleRate is the probability of tracing a write (default: 1)
+	SampleRate float64 `toml:"sample-rate" yaml:"sample-rate" json:"sample-rate"`
+
+	// ServiceName identifies the relay in the traces (default: influxdb-relay)
+	ServiceName string `toml:"service-name" yaml:"service-name" json:"service-name"`
 }
 
 // Filter represents a regex which may be
 // applied to the incoming requests
 type Filter struct {
 	// Type is how the regex result will be interpreted
-	Type string `toml:"type"`
+	Type string `toml:"type" yaml:"type" json:"type"`
 
 	// TagExpression is a valid Go regex
 	// It will be applied on each tag of any request to the backend
-	TagExpression string `toml:"tag-expression"`
+	TagExpression string `toml:"tag-expression" yaml:"tag-expression" json:"tag-expression"`
 
 	// MeasurementExpression is a valid Go regex
 	// It will be applied on the measurement of any request to the backend
-	MeasurementExpression string `toml:"measurement-expression"`
+	MeasurementExpression string `toml:"measurement-expression" yaml:"measurement-expression" json:"measurement-expression"`
 
 	// TagRegexp is the compiled tag regexp
-	TagRegexp *regexp.Regexp
+	TagRegexp *regexp.Regexp `toml:"-" yaml:"-" json:"-"`
 
 	// MeasurementRegexp is the compiled measurement regexp
-	MeasurementRegexp *regexp.Regexp
+	MeasurementRegexp *regexp.Regexp `toml:"-" yaml:"-" json:"-"`
 
 	// Outputs are the endoints the regex are applied on
-	Outputs []string `toml:"outputs"`
+	Outputs []string `toml:"outputs" yaml:"outputs" json:"outputs"`
 }
 
 // Filters is a type representing an array of Filter, wow
@@ -47,101 +179,323 @@ type Filters []Filter
 // HTTPConfig represents an HTTP relay
 type HTTPConfig struct {
 	// Name identifies the HTTP relay
-	Name string `toml:"name"`
+	Name string `toml:"name" yaml:"name" json:"name"`
 
 	// Addr should be set to the desired listening host:port
-	Addr string `toml:"bind-addr"`
+	Addr string `toml:"bind-addr" yaml:"bind-addr" json:"bind-addr"`
 
 	// Set certificate in order to handle HTTPS requests
-	SSLCombinedPem string `toml:"ssl-combined-pem"`
+	SSLCombinedPem string `toml:"ssl-combined-pem" yaml:"ssl-combined-pem" json:"ssl-combined-pem"`
 
 	// Default retention policy to set for forwarded requests
-	DefaultRetentionPolicy string `toml:"default-retention-policy"`
+	DefaultRetentionPolicy string `toml:"default-retention-policy" yaml:"default-retention-policy" json:"default-retention-policy"`
 
-	DefaultPingResponse int `toml:"default-ping-response"`
+	DefaultPingResponse int `toml:"default-ping-response" yaml:"default-ping-response" json:"default-ping-response"`
 
 	// Rate limit on specific HTTP relay
-	RateLimit int `toml:"rate-limit"`
+	RateLimit int `toml:"rate-limit" yaml:"rate-limit" json:"rate-limit"`
 
 	// Burst allowed by rate limit
-	BurstLimit int `toml:"burst-limit"`
+	BurstLimit int `toml:"burst-limit" yaml:"burst-limit" json:"burst-limit"`
 
 	// Outputs is a list of backed servers where writes will be forwarded
-	Outputs []HTTPOutputConfig `toml:"output"`
+	Outputs []HTTPOutputConfig `toml:"output" yaml:"output" json:"output"`
+
+	HealthTimeout int64 `toml:"health-timeout-ms" yaml:"health-timeout-ms" json:"health-timeout-ms"`
+
+	// MetricsPath serves the metrics on this relay listener, if set
+	MetricsPath string `toml:"metrics-path" yaml:"metrics-path" json:"metrics-path"`
+
+	// LogLevel overrides the log level for this relay
+	LogLevel string `toml:"log-level" yaml:"log-level" json:"log-level"`
+
+	// AccessLog describes the log of the requests received by this relay
+	AccessLog AccessLogConfig `toml:"access-log" yaml:"access-log" json:"access-log"`
+
+	// Passthrough forwards the writes without parsing them again when no
+	// output filters the points nor normalizes their precision
+	Passthrough bool `toml:"passthrough" yaml:"passthrough" json:"passthrough"`
+
+	// PassthroughValidate checks that each line of a write forwarded as is
+	// looks like a point, without parsing it
+	PassthroughValidate bool `toml:"passthrough-validate" yaml:"passthrough-validate" json:"passthrough-validate"`
+
+	// AsyncAck acknowledges the writes before they are sent to the outputs
+	AsyncAck AsyncAckConfig `toml:"async-ack" yaml:"async-ack" json:"async-ack"`
+
+	// MaxBodySizeMB rejects the requests with a larger body, once
+	// decompressed (default: 0, unlimited)
+	MaxBodySizeMB int `toml:"max-body-size-mb" yaml:"max-body-size-mb" json:"max-body-size-mb"`
+
+	// StreamThresholdMB forwards the writes with a larger body by chunks,
+	// without reading them whole (default: 0, disabled)
+	StreamThresholdMB int `toml:"stream-threshold-mb" yaml:"stream-threshold-mb" json:"stream-threshold-mb"`
+
+	// StreamChunkPoints is the number of points of each chunk of a streamed
+	// write (default: 10000)
+	StreamChunkPoints int `toml:"stream-chunk-points" yaml:"stream-chunk-points" json:"stream-chunk-points"`
+}
+
+// AsyncAckConfig represents the queues of the writes acknowledged by an HTTP
+// relay before being sent, the writes being queued for each output
+type AsyncAckConfig struct {
+	// Enabled acknowledges the writes once parsed and queued (default: false)
+	Enabled bool `toml:"enabled" yaml:"enabled" json:"enabled"`
+
+	// QueueSizeMB is an upper limit on the writes queued for each output (default: 16)
+	QueueSizeMB int `toml:"queue-size-mb" yaml:"queue-size-mb" json:"queue-size-mb"`
+
+	// MaxBatchKB is the maximum size of the batches sent from a queue (default: 512)
+	MaxBatchKB int `toml:"max-batch-kb" yaml:"max-batch-kb" json:"max-batch-kb"`
+
+	// Senders is the number of batches of each queue sent at once (default: 1)
+	Senders int `toml:"senders" yaml:"senders" json:"senders"`
+
+	// HighWatermark is the share of a queue above which the writes are only
+	// acknowledged once sent (default: 0.8)
+	HighWatermark float64 `toml:"high-watermark" yaml:"high-watermark" json:"high-watermark"`
+
+	// LowWatermark is the share of the queues below which the writes are
+	// acknowledged at once again (default: 0.5)
+	LowWatermark float64 `toml:"low-watermark" yaml:"low-watermark" json:"low-watermark"`
+}
+
+// Supported access log formats
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// AccessLogConfig represents the access log of an HTTP relay
+type AccessLogConfig struct {
+	// Enabled writes a line per request received by the relay
+	Enabled bool `toml:"enabled" yaml:"enabled" json:"enabled"`
+
+	// Format of the lines: common, combined or json (default: combined)
+	Format string `toml:"format" yaml:"format" json:"format"`
+
+	// Output is stdout, stderr or the path of a file (default: stdout)
+	Output string `toml:"output" yaml:"output" json:"output"`
+
+	// MaxSizeMB rotates the file once it reaches this size (default: 0, no rotation)
+	MaxSizeMB int `toml:"max-size-mb" yaml:"max-size-mb" json:"max-size-mb"`
 
-	HealthTimeout int64 `toml:"health-timeout-ms"`
+	// MaxBackups is the number of rotated files kept (default: 5)
+	MaxBackups int `toml:"max-backups" yaml:"max-backups" json:"max-backups"`
 }
 
 // HTTPOutputConfig represents the specification of an HTTP backend target
 type HTTPOutputConfig struct {
 	// Name of the backend server
-	Name string `toml:"name"`
+	Name string `toml:"name" yaml:"name" json:"name"`
 
 	// Location should be set to the hostname for the influxdb endpoint (for example https://influxdb.com/)
-	Location string `toml:"location"`
+	Location string `toml:"location" yaml:"location" json:"location"`
 
 	// Endpoints should contain the path to the different influxdb endpoints used
-	Endpoints HTTPEndpointConfig `toml:"endpoints"`
+	Endpoints HTTPEndpointConfig `toml:"endpoints" yaml:"endpoints" json:"endpoints"`
 
 	// Timeout sets a per-backend timeout for write requests (default: 10s)
 	// The format used is the same seen in time.ParseDuration
-	Timeout string `toml:"timeout"`
+	Timeout string `toml:"timeout" yaml:"timeout" json:"timeout"`
+
+	// Precision normalizes the timestamps of the writes sent to the backend,
+	// rewriting their precision query parameter (default: the one of each write)
+	Precision string `toml:"precision" yaml:"precision" json:"precision"`
+
+	// Compression of the writes sent to the backend, none or gzip (default: none)
+	Compression string `toml:"compression" yaml:"compression" json:"compression"`
+
+	// CompressionLevel is the gzip level, from 1 (fastest) to 9 (smallest) (default: 6)
+	CompressionLevel int `toml:"compression-level" yaml:"compression-level" json:"compression-level"`
+
+	// CoalesceLinger is how long a write waits for the next ones, in order to
+	// send them together, coalescing is disabled when it is not set
+	// The format used is the same seen in time.ParseDuration
+	CoalesceLinger string `toml:"coalesce-linger" yaml:"coalesce-linger" json:"coalesce-linger"`
+
+	// CoalesceMaxKB is the maximum size of the coalesced writes in KB (default: 512)
+	CoalesceMaxKB int `toml:"coalesce-max-kb" yaml:"coalesce-max-kb" json:"coalesce-max-kb"`
 
 	// Buffer failed writes up to maximum count (default: 0, retry/buffering disabled)
-	BufferSizeMB int `toml:"buffer-size-mb"`
+	BufferSizeMB int `toml:"buffer-size-mb" yaml:"buffer-size-mb" json:"buffer-size-mb"`
 
 	// Maximum batch size in KB (default: 512)
-	MaxBatchKB int `toml:"max-batch-kb"`
+	MaxBatchKB int `toml:"max-batch-kb" yaml:"max-batch-kb" json:"max-batch-kb"`
+
+	// BufferCompression gzips the writes held in the retry buffer,
+	// buffer-size-mb being the size of the compressed writes
+	BufferCompression bool `toml:"buffer-compression" yaml:"buffer-compression" json:"buffer-compression"`
+
+	// OverflowPolicy tells what happens to the writes which do not fit in
+	// the retry buffer: drop-newest, drop-oldest, block or spill (default: drop-newest)
+	OverflowPolicy string `toml:"overflow-policy" yaml:"overflow-policy" json:"overflow-policy"`
+
+	// OverflowTimeout is how long the block policy waits for room in the buffer
+	// The format used is the same seen in time.ParseDuration (default: 10s)
+	OverflowTimeout string `toml:"overflow-timeout" yaml:"overflow-timeout" json:"overflow-timeout"`
+
+	// SpillPath is the directory where the spill policy writes the
+	// batches which do not fit in memory
+	SpillPath string `toml:"spill-path" yaml:"spill-path" json:"spill-path"`
+
+	// SpillSizeMB is the maximum size of the spilled batches (default: 1024)
+	SpillSizeMB int `toml:"spill-size-mb" yaml:"spill-size-mb" json:"spill-size-mb"`
 
 	// Maximum delay between retry attempts
 	// The format used is the same seen in time.ParseDuration (default: 10s)
-	MaxDelayInterval string `toml:"max-delay-interval"`
+	MaxDelayInterval string `toml:"max-delay-interval" yaml:"max-delay-interval" json:"max-delay-interval"`
+
+	// MaxAttempts is the number of times a buffered batch is sent before
+	// being moved to the dead letter (default: 0, unlimited)
+	MaxAttempts int `toml:"max-attempts" yaml:"max-attempts" json:"max-attempts"`
+
+	// MaxAge is the age after which a buffered batch is moved to the dead letter
+	// The format used is the same seen in time.ParseDuration (default: unlimited)
+	MaxAge string `toml:"max-age" yaml:"max-age" json:"max-age"`
+
+	// SplitBatches retries in halves the batches out of attempts which were
+	// rejected with a 5xx response, in order to isolate the faulty points
+	SplitBatches bool `toml:"split-batches" yaml:"split-batches" json:"split-batches"`
+
+	// DeadLetter stores the batches given up by the retry buffer
+	DeadLetter DeadLetterConfig `toml:"dead-letter" yaml:"dead-letter" json:"dead-letter"`
+
+	// DrainBeforePassthrough keeps buffering the new writes until the retry
+	// buffer is empty, so that they are not written before the older ones
+	DrainBeforePassthrough bool `toml:"drain-before-passthrough" yaml:"drain-before-passthrough" json:"drain-before-passthrough"`
+
+	// DrainRateKB limits the KB per second sent from the retry buffer (default: 0, unlimited)
+	// The limit is shared by all the retry workers
+	DrainRateKB int `toml:"drain-rate-kb" yaml:"drain-rate-kb" json:"drain-rate-kb"`
+
+	// RetryWorkers is the number of batches sent at once from the retry
+	// buffer, the batches of a database being sent one at a time (default: 1)
+	RetryWorkers int `toml:"retry-workers" yaml:"retry-workers" json:"retry-workers"`
+
+	// Delay before the second attempt of a buffered batch, up to
+	// MaxDelayInterval, each delay being jittered between its half and
+	// its full value
+	// The format used is the same seen in time.ParseDuration (default: 500ms)
+	RetryInitialInterval string `toml:"retry-initial-interval" yaml:"retry-initial-interval" json:"retry-initial-interval"`
+
+	// Factor applied to the delay after each failed attempt, up to
+	// MaxDelayInterval (default: 2)
+	RetryMultiplier float64 `toml:"retry-multiplier" yaml:"retry-multiplier" json:"retry-multiplier"`
+
+	// CircuitBreaker stops sending writes to a failing backend for a while
+	CircuitBreaker CircuitBreakerConfig `toml:"circuit-breaker" yaml:"circuit-breaker" json:"circuit-breaker"`
 
 	// Skip TLS verification in order to use self signed certificate
 	// WARNING: It's insecure, use it only for developing and don't use in production
-	SkipTLSVerification bool `toml:"skip-tls-verification"`
+	SkipTLSVerification bool `toml:"skip-tls-verification" yaml:"skip-tls-verification" json:"skip-tls-verification"`
+}
+
+// Supported compressions of the writes sent to the backends
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// Supported retry buffer overflow policies
+const (
+	OverflowDropNewest = "drop-newest"
+	OverflowDropOldest = "drop-oldest"
+	OverflowBlock      = "block"
+	OverflowSpill      = "spill"
+)
+
+// Supported dead letter types
+const (
+	DeadLetterMemory = "memory"
+	DeadLetterFile   = "file"
+	DeadLetterOutput = "output"
+)
+
+// CircuitBreakerConfig describes when the writes to a backend are failed
+// at once, or buffered at once, instead of waiting for its timeout
+type CircuitBreakerConfig struct {
+	Enabled bool `toml:"enabled" yaml:"enabled" json:"enabled"`
+
+	// FailureRatio of the writes of a window which opens the circuit (default: 0.5)
+	FailureRatio float64 `toml:"failure-ratio" yaml:"failure-ratio" json:"failure-ratio"`
+
+	// MinRequests is the number of writes of a window needed to open the circuit (default: 10)
+	MinRequests int `toml:"min-requests" yaml:"min-requests" json:"min-requests"`
+
+	// Window over which the failures are counted
+	// The format used is the same seen in time.ParseDuration (default: 10s)
+	Window string `toml:"window" yaml:"window" json:"window"`
+
+	// OpenDuration is how long no write is sent once the circuit opened
+	// The format used is the same seen in time.ParseDuration (default: 30s)
+	OpenDuration string `toml:"open-duration" yaml:"open-duration" json:"open-duration"`
+
+	// HalfOpenProbes is the number of writes sent once the circuit is half
+	// open, all of them must succeed to close it (default: 1)
+	HalfOpenProbes int `toml:"half-open-probes" yaml:"half-open-probes" json:"half-open-probes"`
 }
 
-//HTTPEndpointConfig details the remote endpoints to use
+// DeadLetterConfig describes where the batches given up by a retry buffer go,
+// they are dropped when no type is set
+type DeadLetterConfig struct {
+	// Type is memory, file or output
+	Type string `toml:"type" yaml:"type" json:"type"`
+
+	// Path is the directory of the file dead letter
+	Path string `toml:"path" yaml:"path" json:"path"`
+
+	// Output is the name of the output of the same relay receiving the batches
+	Output string `toml:"output" yaml:"output" json:"output"`
+
+	// MaxSizeMB bounds the memory dead letter, the oldest batches being dropped (default: 16)
+	MaxSizeMB int `toml:"max-size-mb" yaml:"max-size-mb" json:"max-size-mb"`
+}
+
+// HTTPEndpointConfig details the remote endpoints to use
 type HTTPEndpointConfig struct {
 	// Must be the standard write endpoint in influxdb.
-	Write string `toml:"write"`
+	Write string `toml:"write" yaml:"write" json:"write"`
 	// Must be the prometheus specific influxdb endpoint
-	PromWrite string `toml:"write_prom"`
+	PromWrite string `toml:"write_prom" yaml:"write_prom" json:"write_prom"`
 	// Must be the ping endpoint
-	Ping string `toml:"ping"`
+	Ping string `toml:"ping" yaml:"ping" json:"ping"`
 	// Must be the query influxdb endpoint
-	Query string `toml:"query"`
+	Query string `toml:"query" yaml:"query" json:"query"`
 }
 
 // UDPConfig represents a UDP relay
 type UDPConfig struct {
 	// Name identifies the UDP relay
-	Name string `toml:"name"`
+	Name string `toml:"name" yaml:"name" json:"name"`
 
 	// Addr is where the UDP relay will listen for packets
-	Addr string `toml:"bind-addr"`
+	Addr string `toml:"bind-addr" yaml:"bind-addr" json:"bind-addr"`
 
 	// Precision sets the precision of the timestamps (input and output)
-	Precision string `toml:"precision"`
+	Precision string `toml:"precision" yaml:"precision" json:"precision"`
 
 	// ReadBuffer sets the socket buffer for incoming connections
-	ReadBuffer int `toml:"read-buffer"`
+	ReadBuffer int `toml:"read-buffer" yaml:"read-buffer" json:"read-buffer"`
+
+	// LogLevel overrides the log level for this relay
+	LogLevel string `toml:"log-level" yaml:"log-level" json:"log-level"`
 
 	// Outputs is a list of backend servers where writes will be forwarded
-	Outputs []UDPOutputConfig `toml:"output"`
+	Outputs []UDPOutputConfig `toml:"output" yaml:"output" json:"output"`
 }
 
 // UDPOutputConfig represents the specification of a UDP backend target
 type UDPOutputConfig struct {
 	// Name identifies the UDP backend
-	Name string `toml:"name"`
+	Name string `toml:"name" yaml:"name" json:"name"`
 
 	// Location should be set to the host:port of the backend server
-	Location string `toml:"location"`
+	Location string `toml:"location" yaml:"location" json:"location"`
 
 	// MTU sets the maximum output payload size, default is 1024
-	MTU int `toml:"mtu"`
+	MTU int `toml:"mtu" yaml:"mtu" json:"mtu"`
 }
 
 // LoadRegexps will try to compile all the eventual regular expressions
@@ -186,26 +540,78 @@ func checkDoubleSlash(endpoint HTTPEndpointConfig) HTTPEndpointConfig {
 	return endpoint
 }
 
+// HTTPOutput looks for an HTTP output by its name among all the HTTP relays,
+// which validation keeps unique
+// Unnamed outputs are identified by their location
+func (c Config) HTTPOutput(name string) (HTTPOutputConfig, bool) {
+	for _, r := range c.HTTPRelays {
+		for _, o := range r.Outputs {
+			if o.Name == name || (o.Name == "" && o.Location == name) {
+				return o, true
+			}
+		}
+	}
+
+	return HTTPOutputConfig{}, false
+}
+
 // LoadConfigFile parses the specified file into a Config object
+// The format of the file is guessed from its extension
+// The configuration is validated, any error is reported as ValidationErrors
 func LoadConfigFile(filename string) (Config, error) {
-	var cfg Config
+	return LoadConfig(filename, "", "")
+}
 
-	f, err := os.Open(filename)
-	if err != nil {
+// LoadConfigFileFormat parses the specified file into a Config object
+// using the given format (toml, yaml or json)
+// An empty format means the format is guessed from the file extension
+func LoadConfigFileFormat(filename string, format string) (Config, error) {
+	return LoadConfig(filename, format, "")
+}
+
+// LoadConfig loads the configuration file, if any, then merges every
+// fragment found in dir, if any, in alphabetical order
+// Included files are loaded and merged as well
+// The format only applies to filename, fragments use their extension
+func LoadConfig(filename string, format string, dir string) (Config, error) {
+	l := newLoader()
+
+	if filename != "" {
+		if err := l.load(filename, format); err != nil {
+			return l.cfg, err
+		}
+	}
+
+	if dir != "" {
+		files, err := configFiles(dir)
+		if err != nil {
+			return l.cfg, err
+		}
+
+		for _, f := range files {
+			if err := l.load(f, ""); err != nil {
+				return l.cfg, err
+			}
+		}
+	}
+
+	cfg := l.cfg
+	errs := l.errs
+	if err, ok := cfg.Validate().(ValidationErrors); ok {
+		errs = append(errs, err...)
+	}
+
+	if err := errs.err(); err != nil {
 		return cfg, err
 	}
-	defer f.Close()
-
-	err = toml.NewDecoder(f).Decode(&cfg)
-	if err == nil {
-		for i, r := range cfg.HTTPRelays {
-			for j, b := range r.Outputs {
-				if b.Location[len(b.Location)-1] == '/' {
-					cfg.HTTPRelays[i].Outputs[j].Endpoints = checkDoubleSlash(b.Endpoints)
-				}
+
+	for i, r := range cfg.HTTPRelays {
+		for j, b := range r.Outputs {
+			if strings.HasSuffix(b.Location, "/") {
+				cfg.HTTPRelays[i].Outputs[j].Endpoints = checkDoubleSlash(b.Endpoints)
 			}
 		}
-		err = cfg.Filters.LoadRegexps()
 	}
-	return cfg, err
+
+	return cfg, cfg.Filters.LoadRegexps()
 }
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFileSamples(t *testing.T) {
+	for _, f := range []string{"../examples/sample.conf", "../examples/sample_buffered.conf", "../examples/kapacitor.conf"} {
+		_, err := LoadConfigFile(f)
+		assert.NoError(t, err, f)
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	_, err := LoadConfigFile("testdata/invalid.toml")
+
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	paths := make([]string, len(errs))
+	for i, e := range errs {
+		paths[i] = e.Path
+	}
+
+	assert.Equal(t, []string{
+		"bogus",
+		"http[0].output[0].endpoints.wat",
+		"http[0].unknownopt",
+		"http[0].access-log.format",
+		"http[0].access-log.max-backups",
+		"http[0].async-ack.low-watermark",
+		"http[0].passthrough-validate",
+		"http[0].stream-chunk-points",
+		"http[0].output[0].location",
+		"http[0].output[0].timeout",
+		"http[0].output[0].precision",
+		"http[0].output[0].spill-path",
+		"http[0].output[0].compression",
+		"http[0].output[0].circuit-breaker.failure-ratio",
+		"http[0].output[1].name",
+		"http[0].output[1].location",
+		"http[0].output[1].coalesce-max-kb",
+		"http[0].output[0].overflow-policy",
+		"http[0].output[1].max-attempts",
+		"http[0].output[1].dead-letter",
+		"http[0].output[1].drain-before-passthrough",
+		"http[0].output[1].retry-workers",
+		"http[0].output[1].dead-letter.output",
+		"http[1].output[0].name",
+		"udp[0].name",
+		"udp[0].bind-addr",
+		"udp[0].log-level",
+		"udp[0].output[0].location",
+		"filter[0].tag-expression",
+		"filter[0].outputs[1]",
+		"monitor.interval",
+		"monitor.output",
+		"tracing.exporter",
+		"tracing.sample-rate",
+		"log.format",
+	}, paths)
+}
+
+func TestValidateBindAddr(t *testing.T) {
+	cfg := Config{
+		HTTPRelays: []HTTPConfig{
+			{Name: "a", Addr: "0.0.0.0:9096"},
+			{Name: "b", Addr: "127.0.0.1:9097"},
+		},
+		UDPRelays: []UDPConfig{
+			{Name: "c", Addr: "127.0.0.1:9096"},
+			{Name: "d", Addr: "127.0.0.2:9097"},
+		},
+	}
+
+	err := cfg.Validate()
+	assert.EqualError(t, err, `udp[0].bind-addr: address "127.0.0.1:9096" conflicts with http[0].bind-addr`)
+}
+
+func TestLoadConfigFileYAML(t *testing.T) {
+	os.Setenv("INFLUXDB02_URL", "http://influxdb02:8086/")
+	defer os.Unsetenv("INFLUXDB02_URL")
+
+	cfg, err := LoadConfigFile("../examples/sample.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8086/", cfg.HTTPRelays[0].Outputs[0].Location)
+	assert.Equal(t, "http://influxdb02:8086/", cfg.HTTPRelays[0].Outputs[1].Location)
+	assert.Equal(t, "write", cfg.HTTPRelays[0].Outputs[1].Endpoints.Write)
+	assert.Equal(t, 512, cfg.UDPRelays[0].Outputs[0].MTU)
+}
+
+func TestLoadConfigFileJSON(t *testing.T) {
+	_, err := LoadConfigFile("testdata/sample.json")
+	assert.EqualError(t, err, `testdata/sample.json: http[0].output[0].location: environment variable "TEST_RELAY_URL" is not set`)
+
+	os.Setenv("TEST_RELAY_URL", "http://influxdb:8086")
+	defer os.Unsetenv("TEST_RELAY_URL")
+
+	cfg, err := LoadConfigFile("testdata/sample.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://influxdb:8086", cfg.HTTPRelays[0].Outputs[0].Location)
+	assert.Equal(t, "5s", cfg.HTTPRelays[0].Outputs[0].Timeout)
+
+	// The format can be forced whatever the extension
+	_, err = LoadConfigFileFormat("testdata/sample.json", FormatTOML)
+	assert.Error(t, err)
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("TEST_RELAY_EMPTY", "")
+	defer os.Unsetenv("TEST_RELAY_EMPTY")
+
+	cfg := Config{HTTPRelays: []HTTPConfig{{
+		Name:                   "${TEST_RELAY_EMPTY}",
+		DefaultRetentionPolicy: "${TEST_RELAY_EMPTY:-x}",
+		MetricsPath:            "$${NOT_EXPANDED}",
+		Outputs:                []HTTPOutputConfig{{Location: "${TEST_RELAY_UNSET}"}},
+	}}}
+	err := ExpandEnv(&cfg)
+	assert.EqualError(t, err, `http[0].output[0].location: environment variable "TEST_RELAY_UNSET" is not set`)
+	assert.Equal(t, "", cfg.HTTPRelays[0].Name)
+	assert.Equal(t, "x", cfg.HTTPRelays[0].DefaultRetentionPolicy)
+	assert.Equal(t, "${NOT_EXPANDED}", cfg.HTTPRelays[0].MetricsPath)
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	// The values cannot add settings to the file
+	os.Setenv("TEST_RELAY_RP", "autogen\"\n[[udp]]\nname = \"injected\"")
+	os.Setenv("TEST_RELAY_TOKEN", "secret")
+	defer os.Unsetenv("TEST_RELAY_RP")
+	defer os.Unsetenv("TEST_RELAY_TOKEN")
+
+	cfg, err := LoadConfigFile("testdata/env.toml")
+	assert.NoError(t, err)
+	assert.Equal(t, "autogen\"\n[[udp]]\nname = \"injected\"", cfg.HTTPRelays[0].DefaultRetentionPolicy)
+	assert.Empty(t, cfg.UDPRelays)
+	assert.Equal(t, map[string]string{"authorization": "Bearer secret"}, cfg.Tracing.Headers)
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	cfg, err := LoadConfigFile("testdata/include/main.toml")
+	assert.NoError(t, err)
+	assert.Nil(t, cfg.Include)
+	assert.Equal(t, 1, len(cfg.HTTPRelays))
+
+	r := cfg.HTTPRelays[0]
+	assert.Equal(t, "127.0.0.1:9096", r.Addr)
+	assert.Equal(t, "autogen", r.DefaultRetentionPolicy)
+
+	var names []string
+	for _, o := range r.Outputs {
+		names = append(names, o.Name)
+	}
+	assert.Equal(t, []string{"influxdb01", "influxdb02", "influxdb03"}, names)
+	assert.Equal(t, 1, len(cfg.Filters))
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	cfg, err := LoadConfig("testdata/conflict/10-a.toml", "", "testdata/include/conf.d")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(cfg.HTTPRelays[0].Outputs))
+
+	// Fragments already included by the main file are not merged twice
+	cfg, err = LoadConfig("testdata/include/main.toml", "", "testdata/include/conf.d")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(cfg.HTTPRelays[0].Outputs))
+}
+
+func TestLoadConfigDirConflict(t *testing.T) {
+	_, err := LoadConfig("", "", "testdata/conflict")
+	assert.EqualError(t, err, `testdata/conflict/20-b.toml: http[0].bind-addr: conflicting value 127.0.0.1:9097, already set to 127.0.0.1:9096
+testdata/conflict/20-b.toml: http[0].output[0]: output "influxdb01" conflicts with a previous definition`)
+}
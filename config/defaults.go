@@ -0,0 +1,272 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Default values used when a setting is omitted from the configuration
+const (
+	DefaultHTTPPingResponse  = http.StatusNoContent
+	DefaultHTTPTimeout       = 10 * time.Second
+	DefaultMaxDelayInterval  = 10 * time.Second
+	DefaultMaxBatchKB        = 512
+	DefaultRetryWorkers      = 1
+	DefaultRetryInterval     = 500 * time.Millisecond
+	DefaultRetryMultiplier   = 2
+	DefaultUDPMTU            = 1024
+	DefaultMetricsAddr       = ":8088"
+	DefaultMetricsPath       = "/metrics"
+	DefaultMonitorInterval   = 10 * time.Second
+	DefaultMonitorDatabase   = "_relay"
+	DefaultTracingEndpoint   = "http://localhost:4318/v1/traces"
+	DefaultTracingService    = "influxdb-relay"
+	DefaultTracingRate       = 1.0
+	DefaultLogSampleInterval = time.Second
+	DefaultAccessLogBackups  = 5
+	DefaultDeadLetterSizeMB  = 16
+	DefaultOverflowTimeout   = 10 * time.Second
+	DefaultSpillSizeMB       = 1024
+	DefaultCompressionLevel  = 6
+	DefaultFailureRatio      = 0.5
+	DefaultMinRequests       = 10
+	DefaultBreakerWindow     = 10 * time.Second
+	DefaultOpenDuration      = 30 * time.Second
+	DefaultHalfOpenProbes    = 1
+	DefaultAckQueueSizeMB    = 16
+	DefaultAckSenders        = 1
+	DefaultHighWatermark     = 0.8
+	DefaultLowWatermark      = 0.5
+	DefaultStreamChunkPoints = 10000
+)
+
+// RelayName returns the name of an HTTP relay, a default name
+// is built from the bind address when it is not specified
+func (c HTTPConfig) RelayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	schema := "http"
+	if c.SSLCombinedPem != "" {
+		schema = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", schema, c.Addr)
+}
+
+// RelayName returns the name of an UDP relay, defaulting to its bind address
+func (c UDPConfig) RelayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	return c.Addr
+}
+
+// SetDefaults fills every omitted setting with its default value
+// so that the configuration reflects what the relays will actually use
+func (c *Config) SetDefaults() {
+	enabled := c.Metrics.IsEnabled()
+	c.Metrics.Enabled = &enabled
+
+	c.Metrics.Addr = c.Metrics.AddrOrDefault()
+	c.Metrics.Path = c.Metrics.PathOrDefault()
+
+	if c.Monitor.Enabled {
+		if c.Monitor.Interval == "" {
+			c.Monitor.Interval = DefaultMonitorInterval.String()
+		}
+
+		if c.Monitor.Database == "" {
+			c.Monitor.Database = DefaultMonitorDatabase
+		}
+	}
+
+	if c.Log.Level == "" {
+		c.Log.Level = LogInfo
+		if c.Verbose {
+			c.Log.Level = LogDebug
+		}
+	}
+
+	if c.Log.Format == "" {
+		c.Log.Format = LogLogfmt
+	}
+
+	if c.Log.Output == "" {
+		c.Log.Output = LogStderr
+	}
+
+	if c.Log.SampleFirst > 0 && c.Log.SampleInterval == "" {
+		c.Log.SampleInterval = DefaultLogSampleInterval.String()
+	}
+
+	if c.Tracing.Exporter != "" {
+		if c.Tracing.Exporter == TracingOTLP && c.Tracing.Endpoint == "" {
+			c.Tracing.Endpoint = DefaultTracingEndpoint
+		}
+
+		if c.Tracing.SampleRate == 0 {
+			c.Tracing.SampleRate = DefaultTracingRate
+		}
+
+		if c.Tracing.ServiceName == "" {
+			c.Tracing.ServiceName = DefaultTracingService
+		}
+	}
+
+	for i := range c.HTTPRelays {
+		r := &c.HTTPRelays[i]
+		r.Name = r.RelayName()
+
+		if r.MetricsPath == "" && enabled && c.Metrics.RelayListeners {
+			r.MetricsPath = c.Metrics.Path
+		}
+
+		if a := &r.AccessLog; a.Enabled {
+			if a.Format == "" {
+				a.Format = AccessLogCombined
+			}
+
+			if a.Output == "" {
+				a.Output = LogStdout
+			}
+
+			if a.MaxSizeMB > 0 && a.MaxBackups == 0 {
+				a.MaxBackups = DefaultAccessLogBackups
+			}
+		}
+
+		if a := &r.AsyncAck; a.Enabled {
+			if a.QueueSizeMB == 0 {
+				a.QueueSizeMB = DefaultAckQueueSizeMB
+			}
+
+			if a.MaxBatchKB == 0 {
+				a.MaxBatchKB = DefaultMaxBatchKB
+			}
+
+			if a.Senders == 0 {
+				a.Senders = DefaultAckSenders
+			}
+
+			if a.HighWatermark == 0 {
+				a.HighWatermark = DefaultHighWatermark
+			}
+
+			if a.LowWatermark == 0 {
+				a.LowWatermark = DefaultLowWatermark
+			}
+		}
+
+		if r.StreamThresholdMB > 0 && r.StreamChunkPoints == 0 {
+			r.StreamChunkPoints = DefaultStreamChunkPoints
+		}
+
+		if r.DefaultPingResponse == 0 {
+			r.DefaultPingResponse = DefaultHTTPPingResponse
+		}
+
+		for j := range r.Outputs {
+			o := &r.Outputs[j]
+			if o.Name == "" {
+				o.Name = o.Location
+			}
+
+			if o.Timeout == "" {
+				o.Timeout = DefaultHTTPTimeout.String()
+			}
+
+			if o.Compression == "" {
+				o.Compression = CompressionNone
+			}
+
+			if b := &o.CircuitBreaker; b.Enabled {
+				if b.FailureRatio == 0 {
+					b.FailureRatio = DefaultFailureRatio
+				}
+
+				if b.MinRequests == 0 {
+					b.MinRequests = DefaultMinRequests
+				}
+
+				if b.Window == "" {
+					b.Window = DefaultBreakerWindow.String()
+				}
+
+				if b.OpenDuration == "" {
+					b.OpenDuration = DefaultOpenDuration.String()
+				}
+
+				if b.HalfOpenProbes == 0 {
+					b.HalfOpenProbes = DefaultHalfOpenProbes
+				}
+			}
+
+			if o.CoalesceLinger != "" && o.CoalesceMaxKB == 0 {
+				o.CoalesceMaxKB = DefaultMaxBatchKB
+			}
+
+			if (o.Compression == CompressionGzip || o.BufferCompression) && o.CompressionLevel == 0 {
+				o.CompressionLevel = DefaultCompressionLevel
+			}
+
+			if o.BufferSizeMB > 0 {
+				if o.MaxBatchKB == 0 {
+					o.MaxBatchKB = DefaultMaxBatchKB
+				}
+
+				if o.MaxDelayInterval == "" {
+					o.MaxDelayInterval = DefaultMaxDelayInterval.String()
+				}
+
+				if o.RetryWorkers == 0 {
+					o.RetryWorkers = DefaultRetryWorkers
+				}
+
+				if o.RetryInitialInterval == "" {
+					o.RetryInitialInterval = DefaultRetryInterval.String()
+				}
+
+				if o.RetryMultiplier == 0 {
+					o.RetryMultiplier = DefaultRetryMultiplier
+				}
+
+				switch o.OverflowPolicy {
+				case "":
+					o.OverflowPolicy = OverflowDropNewest
+				case OverflowBlock:
+					if o.OverflowTimeout == "" {
+						o.OverflowTimeout = DefaultOverflowTimeout.String()
+					}
+				case OverflowSpill:
+					if o.SpillSizeMB == 0 {
+						o.SpillSizeMB = DefaultSpillSizeMB
+					}
+				}
+
+				if d := &o.DeadLetter; d.Type == DeadLetterMemory && d.MaxSizeMB == 0 {
+					d.MaxSizeMB = DefaultDeadLetterSizeMB
+				}
+			}
+		}
+	}
+
+	for i := range c.UDPRelays {
+		r := &c.UDPRelays[i]
+		r.Name = r.RelayName()
+
+		for j := range r.Outputs {
+			o := &r.Outputs[j]
+			if o.Name == "" {
+				o.Name = o.Location
+			}
+
+			if o.MTU == 0 {
+				o.MTU = DefaultUDPMTU
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envPattern matches ${VAR} and ${VAR:-default}, $${ being an escaped ${
+var envPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandEnv replaces ${VAR} with the value of the environment variable VAR
+// in the string settings of a decoded configuration, so that a value can
+// neither change the structure of the file nor be read from a comment
+// ${VAR:-default} falls back on default when VAR is unset or empty
+// Referencing an unset variable without a default value is an error
+func ExpandEnv(cfg *Config) error {
+	var errs ValidationErrors
+	expandValue(reflect.ValueOf(cfg).Elem(), "", &errs)
+	return errs.err()
+}
+
+// expandValue expands the strings held by v, whatever their depth
+func expandValue(v reflect.Value, path string, errs *ValidationErrors) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(expandString(v.String(), path, errs))
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			key := reflect.ValueOf(k)
+			value := expandString(v.MapIndex(key).String(), keyPath(path, k), errs)
+			v.SetMapIndex(key, reflect.ValueOf(value))
+		}
+
+	case reflect.Struct:
+		typ := v.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			name := strings.Split(f.Tag.Get("toml"), ",")[0]
+			if name == "-" || f.PkgPath != "" {
+				continue
+			}
+
+			expandValue(v.Field(i), keyPath(path, name), errs)
+		}
+	}
+}
+
+func expandString(s string, path string, errs *ValidationErrors) string {
+	return envPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$${" {
+			return "${"
+		}
+
+		sub := envPattern.FindStringSubmatch(m)
+		name := sub[1]
+
+		value, ok := os.LookupEnv(name)
+		if sub[2] != "" && value == "" {
+			return sub[3]
+		}
+
+		if !ok {
+			errs.add(path, "environment variable %q is not set", name)
+		}
+
+		return value
+	})
+}
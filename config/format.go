@@ -0,0 +1,217 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/naoina/toml"
+	"github.com/naoina/toml/ast"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported configuration formats
+const (
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// FormatFromFilename guesses the format of a configuration file
+// from its extension, TOML being used by default
+func FormatFromFilename(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	default:
+		return FormatTOML
+	}
+}
+
+// decode fills cfg from data, unknown keys are returned as
+// validation errors while syntax errors are returned as is
+func decode(data []byte, format string, cfg *Config) (ValidationErrors, error) {
+	typ := reflect.TypeOf(*cfg)
+
+	switch format {
+	case FormatTOML:
+		t, err := toml.Parse(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Unknown keys are collected beforehand so they can all be
+		// reported at once along with the other validation errors
+		errs := unknownKeys(t, typ, "")
+
+		decoder := toml.DefaultConfig
+		decoder.MissingField = func(reflect.Type, string) error { return nil }
+		return errs, decoder.UnmarshalTable(t, cfg)
+
+	case FormatYAML:
+		var raw interface{}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+
+		return unknownFields(raw, typ, ""), yaml.Unmarshal(data, cfg)
+
+	case FormatJSON:
+		var raw interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+
+		return unknownFields(raw, typ, ""), json.Unmarshal(data, cfg)
+
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q", format)
+	}
+}
+
+// Encode writes the configuration in the given format
+func (c Config) Encode(format string) ([]byte, error) {
+	switch format {
+	case FormatTOML, "":
+		return toml.Marshal(c)
+	case FormatYAML:
+		return yaml.Marshal(c)
+	case FormatJSON:
+		data, err := json.MarshalIndent(c, "", "  ")
+		return append(data, '\n'), err
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q", format)
+	}
+}
+
+// configKeys returns the keys accepted for a struct type
+// The same key is used whatever the format of the file
+func configKeys(typ reflect.Type) map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		keys[name] = f.Type
+	}
+
+	return keys
+}
+
+func structType(typ reflect.Type) (reflect.Type, bool) {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+
+	return typ, typ.Kind() == reflect.Struct
+}
+
+func keyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// unknownKeys walks the parsed TOML document and reports every
+// key which does not correspond to a configuration setting
+func unknownKeys(t *ast.Table, typ reflect.Type, path string) ValidationErrors {
+	var errs ValidationErrors
+
+	typ, ok := structType(typ)
+	if !ok {
+		return nil
+	}
+
+	keys := configKeys(typ)
+	names := make([]string, 0, len(t.Fields))
+	for k := range t.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		p := keyPath(path, k)
+
+		ft, ok := keys[k]
+		if !ok {
+			errs.add(p, "unknown key %q", k)
+			continue
+		}
+
+		switch f := t.Fields[k].(type) {
+		case *ast.Table:
+			errs = append(errs, unknownKeys(f, ft, p)...)
+		case []*ast.Table:
+			for i, sub := range f {
+				errs = append(errs, unknownKeys(sub, ft, fmt.Sprintf("%s[%d]", p, i))...)
+			}
+		case *ast.KeyValue:
+			if sub, ok := f.Value.(*ast.Table); ok {
+				errs = append(errs, unknownKeys(sub, ft, p)...)
+			}
+		}
+	}
+
+	return errs
+}
+
+// unknownFields does the same as unknownKeys for documents
+// decoded from YAML or JSON
+func unknownFields(v interface{}, typ reflect.Type, path string) ValidationErrors {
+	var errs ValidationErrors
+
+	typ, ok := structType(typ)
+	if !ok {
+		return nil
+	}
+
+	fields := make(map[string]interface{})
+	switch m := v.(type) {
+	case map[string]interface{}:
+		fields = m
+	case map[interface{}]interface{}:
+		for k, f := range m {
+			fields[fmt.Sprint(k)] = f
+		}
+	case []interface{}:
+		for i, sub := range m {
+			errs = append(errs, unknownFields(sub, typ, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return errs
+	default:
+		return nil
+	}
+
+	keys := configKeys(typ)
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		p := keyPath(path, k)
+
+		ft, ok := keys[k]
+		if !ok {
+			errs.add(p, "unknown key %q", k)
+			continue
+		}
+
+		errs = append(errs, unknownFields(fields[k], ft, p)...)
+	}
+
+	return errs
+}
@@ -0,0 +1,272 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// loader reads configuration files and merges them into a single Config
+type loader struct {
+	cfg    Config
+	errs   ValidationErrors
+	loaded map[string]bool
+}
+
+func newLoader() *loader {
+	return &loader{loaded: make(map[string]bool)}
+}
+
+// configFiles lists the configuration fragments of a directory
+func configFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		switch filepath.Ext(e.Name()) {
+		case ".toml", ".conf", ".yaml", ".yml", ".json":
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// load decodes a file, merges it and then loads its includes
+// A file which has already been loaded is silently skipped
+func (l *loader) load(filename string, format string) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	if format == "" {
+		format = FormatFromFilename(filename)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var cfg Config
+	errs, err := decode(data, format, &cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	l.errs = append(l.errs, errs.inFile(filename)...)
+
+	// Environment variables are expanded in the decoded values,
+	// includes included
+	if errs, ok := ExpandEnv(&cfg).(ValidationErrors); ok {
+		return errs.inFile(filename)
+	}
+
+	include := cfg.Include
+	cfg.Include = nil
+	l.errs = append(l.errs, l.cfg.Merge(cfg).inFile(filename)...)
+
+	for _, pattern := range include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include %q: %v", filename, pattern, err)
+		}
+
+		if matches == nil && !hasMeta(pattern) {
+			return fmt.Errorf("%s: included file %q: %v", filename, pattern, os.ErrNotExist)
+		}
+
+		for _, m := range matches {
+			if err := l.load(m, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasMeta(pattern string) bool {
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[':
+			return true
+		}
+	}
+
+	return false
+}
+
+// Merge adds the relays and filters of o into c
+// Relays with the same name are merged: their outputs are appended
+// and their settings must either be equal or set on one side only
+// Outputs with the same name must be identical
+// Identical filters are only kept once
+func (c *Config) Merge(o Config) ValidationErrors {
+	var errs ValidationErrors
+
+	for i, r := range o.HTTPRelays {
+		path := fmt.Sprintf("http[%d]", i)
+
+		j := -1
+		for k := range c.HTTPRelays {
+			if c.HTTPRelays[k].RelayName() == r.RelayName() {
+				j = k
+				break
+			}
+		}
+
+		if j < 0 {
+			c.HTTPRelays = append(c.HTTPRelays, r)
+			continue
+		}
+
+		dst := &c.HTTPRelays[j]
+		errs = append(errs, mergeSettings(path, reflect.ValueOf(dst).Elem(), reflect.ValueOf(r))...)
+
+		for n, out := range r.Outputs {
+			p := fmt.Sprintf("%s.output[%d]", path, n)
+			if conflict, found := findHTTPOutput(dst.Outputs, out); found {
+				if conflict {
+					errs.add(p, "output %q conflicts with a previous definition", outputName(out.Name, out.Location))
+				}
+				continue
+			}
+			dst.Outputs = append(dst.Outputs, out)
+		}
+	}
+
+	for i, r := range o.UDPRelays {
+		path := fmt.Sprintf("udp[%d]", i)
+
+		j := -1
+		for k := range c.UDPRelays {
+			if c.UDPRelays[k].RelayName() == r.RelayName() {
+				j = k
+				break
+			}
+		}
+
+		if j < 0 {
+			c.UDPRelays = append(c.UDPRelays, r)
+			continue
+		}
+
+		dst := &c.UDPRelays[j]
+		errs = append(errs, mergeSettings(path, reflect.ValueOf(dst).Elem(), reflect.ValueOf(r))...)
+
+		for n, out := range r.Outputs {
+			p := fmt.Sprintf("%s.output[%d]", path, n)
+			if conflict, found := findUDPOutput(dst.Outputs, out); found {
+				if conflict {
+					errs.add(p, "output %q conflicts with a previous definition", outputName(out.Name, out.Location))
+				}
+				continue
+			}
+			dst.Outputs = append(dst.Outputs, out)
+		}
+	}
+
+	errs = append(errs, mergeSettings("metrics", reflect.ValueOf(&c.Metrics).Elem(), reflect.ValueOf(o.Metrics))...)
+	errs = append(errs, mergeSettings("monitor", reflect.ValueOf(&c.Monitor).Elem(), reflect.ValueOf(o.Monitor))...)
+	errs = append(errs, mergeSettings("tracing", reflect.ValueOf(&c.Tracing).Elem(), reflect.ValueOf(o.Tracing))...)
+	errs = append(errs, mergeSettings("log", reflect.ValueOf(&c.Log).Elem(), reflect.ValueOf(o.Log))...)
+
+	for _, f := range o.Filters {
+		duplicate := false
+		for _, e := range c.Filters {
+			if reflect.DeepEqual(e, f) {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			c.Filters = append(c.Filters, f)
+		}
+	}
+
+	return errs
+}
+
+func outputName(name, location string) string {
+	if name == "" {
+		return location
+	}
+
+	return name
+}
+
+// findHTTPOutput looks for an output with the same name,
+// conflict is set if both definitions are different
+func findHTTPOutput(outputs []HTTPOutputConfig, o HTTPOutputConfig) (conflict bool, found bool) {
+	for _, e := range outputs {
+		if outputName(e.Name, e.Location) == outputName(o.Name, o.Location) {
+			return !reflect.DeepEqual(e, o), true
+		}
+	}
+
+	return false, false
+}
+
+// findUDPOutput does the same as findHTTPOutput for UDP outputs
+func findUDPOutput(outputs []UDPOutputConfig, o UDPOutputConfig) (conflict bool, found bool) {
+	for _, e := range outputs {
+		if outputName(e.Name, e.Location) == outputName(o.Name, o.Location) {
+			return !reflect.DeepEqual(e, o), true
+		}
+	}
+
+	return false, false
+}
+
+// mergeSettings copies the settings of src which are not set in dst
+// Settings set on both sides with different values are reported
+// Name and outputs are handled by the caller
+func mergeSettings(path string, dst, src reflect.Value) ValidationErrors {
+	var errs ValidationErrors
+
+	typ := dst.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Name == "Name" || f.Name == "Outputs" {
+			continue
+		}
+
+		d, s := dst.Field(i), src.Field(i)
+		switch {
+		case isZero(s) || reflect.DeepEqual(d.Interface(), s.Interface()):
+		case isZero(d):
+			d.Set(s)
+		default:
+			errs.add(path+"."+strings.Split(f.Tag.Get("toml"), ",")[0], "conflicting value %v, already set to %v", s.Interface(), d.Interface())
+		}
+	}
+
+	return errs
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,514 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ValidationError is a problem found at a given path of the configuration
+// Paths use the TOML naming, for instance http[0].output[1].timeout
+// File is set when the problem is specific to one of the loaded files
+type ValidationError struct {
+	File    string
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	msg := e.Message
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+
+	if e.File != "" {
+		msg = e.File + ": " + msg
+	}
+
+	return msg
+}
+
+// ValidationErrors gathers every problem found in a configuration
+type ValidationErrors []*ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func (v *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*v = append(*v, &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// inFile sets the file of the errors which do not have one yet
+func (v ValidationErrors) inFile(file string) ValidationErrors {
+	for _, e := range v {
+		if e.File == "" {
+			e.File = file
+		}
+	}
+
+	return v
+}
+
+// err returns nil when no problem has been found, so that
+// the result can be compared with nil by the callers
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	return v
+}
+
+type bindAddr struct {
+	path string
+	host string
+	port string
+}
+
+// conflicts tells whether two listeners would fight for the same port
+// An empty or unspecified host listens on every interface
+func (b bindAddr) conflicts(o bindAddr) bool {
+	if b.port != o.port {
+		return false
+	}
+
+	wildcard := func(h string) bool {
+		ip := net.ParseIP(h)
+		return h == "" || (ip != nil && ip.IsUnspecified())
+	}
+
+	return b.host == o.host || wildcard(b.host) || wildcard(o.host)
+}
+
+var validLogLevels = map[string]bool{
+	"": true, LogDebug: true, LogInfo: true, LogWarn: true, LogError: true,
+}
+
+var validPrecisions = map[string]bool{
+	"": true, "n": true, "ns": true, "u": true, "us": true, "ms": true, "s": true, "m": true, "h": true,
+}
+
+type validator struct {
+	errs    ValidationErrors
+	relays  map[string]string
+	outputs map[string]string
+	addrs   []bindAddr
+}
+
+func (v *validator) duration(path, value string) {
+	if value == "" {
+		return
+	}
+
+	if d, err := time.ParseDuration(value); err != nil {
+		v.errs.add(path, "invalid duration %q", value)
+	} else if d < 0 {
+		v.errs.add(path, "negative duration %q", value)
+	}
+}
+
+func (v *validator) nonNegative(path string, value int) {
+	if value < 0 {
+		v.errs.add(path, "must not be negative, got %d", value)
+	}
+}
+
+func (v *validator) logLevel(path, level string) {
+	if !validLogLevels[strings.ToLower(level)] {
+		v.errs.add(path, "unknown log level %q", level)
+	}
+}
+
+func (v *validator) accessLog(path string, a AccessLogConfig) {
+	switch a.Format {
+	case "", AccessLogCommon, AccessLogCombined, AccessLogJSON:
+	default:
+		v.errs.add(path+".format", "unknown format %q, expecting %s, %s or %s", a.Format, AccessLogCommon, AccessLogCombined, AccessLogJSON)
+	}
+
+	v.nonNegative(path+".max-size-mb", a.MaxSizeMB)
+	v.nonNegative(path+".max-backups", a.MaxBackups)
+}
+
+func (v *validator) asyncAck(path string, a AsyncAckConfig) {
+	v.nonNegative(path+".queue-size-mb", a.QueueSizeMB)
+	v.nonNegative(path+".max-batch-kb", a.MaxBatchKB)
+	v.nonNegative(path+".senders", a.Senders)
+
+	if a.HighWatermark < 0 || a.HighWatermark > 1 {
+		v.errs.add(path+".high-watermark", "must be between 0 and 1, got %v", a.HighWatermark)
+	}
+
+	if a.LowWatermark < 0 || a.LowWatermark > 1 {
+		v.errs.add(path+".low-watermark", "must be between 0 and 1, got %v", a.LowWatermark)
+	} else if a.HighWatermark != 0 && a.LowWatermark > a.HighWatermark {
+		v.errs.add(path+".low-watermark", "must not be above the high watermark %v, got %v", a.HighWatermark, a.LowWatermark)
+	}
+}
+
+func (v *validator) relay(path, name string) {
+	if other, ok := v.relays[name]; ok {
+		v.errs.add(path+".name", "duplicate relay name %q, already used by %s", name, other)
+		return
+	}
+
+	v.relays[name] = path
+}
+
+func (v *validator) bind(path, addr string) {
+	if addr == "" {
+		v.errs.add(path, "missing bind address")
+		return
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.errs.add(path, "invalid bind address %q: %v", addr, err)
+		return
+	}
+
+	b := bindAddr{path: path, host: host, port: port}
+	for _, o := range v.addrs {
+		if b.conflicts(o) {
+			v.errs.add(path, "address %q conflicts with %s", addr, o.path)
+		}
+	}
+	v.addrs = append(v.addrs, b)
+}
+
+func (v *validator) httpRelay(path string, r HTTPConfig) {
+	v.relay(path, r.RelayName())
+	v.bind(path+".bind-addr", r.Addr)
+	v.nonNegative(path+".rate-limit", r.RateLimit)
+	v.nonNegative(path+".burst-limit", r.BurstLimit)
+	v.logLevel(path+".log-level", r.LogLevel)
+	v.accessLog(path+".access-log", r.AccessLog)
+	v.asyncAck(path+".async-ack", r.AsyncAck)
+	if r.PassthroughValidate && !r.Passthrough {
+		v.errs.add(path+".passthrough-validate", "requires passthrough")
+	}
+
+	v.nonNegative(path+".max-body-size-mb", r.MaxBodySizeMB)
+	v.nonNegative(path+".stream-threshold-mb", r.StreamThresholdMB)
+	v.nonNegative(path+".stream-chunk-points", r.StreamChunkPoints)
+	if r.StreamChunkPoints != 0 && r.StreamThresholdMB == 0 {
+		v.errs.add(path+".stream-chunk-points", "requires stream-threshold-mb")
+	}
+
+	if r.HealthTimeout < 0 {
+		v.errs.add(path+".health-timeout-ms", "must not be negative, got %d", r.HealthTimeout)
+	}
+
+	if r.MetricsPath != "" && !strings.HasPrefix(r.MetricsPath, "/") {
+		v.errs.add(path+".metrics-path", "must start with /, got %q", r.MetricsPath)
+	}
+
+	if r.DefaultPingResponse != 0 && (r.DefaultPingResponse < 100 || r.DefaultPingResponse > 599) {
+		v.errs.add(path+".default-ping-response", "invalid HTTP status code %d", r.DefaultPingResponse)
+	}
+
+	names := make(map[string]string)
+	for i, o := range r.Outputs {
+		out := fmt.Sprintf("%s.output[%d]", path, i)
+
+		name := o.Name
+		if name == "" {
+			name = o.Location
+		}
+
+		// The outputs are looked up by name among all the relays,
+		// by the filters, the monitor and the replay subcommand
+		if other, ok := v.outputs[name]; ok {
+			v.errs.add(out+".name", "duplicate output name %q, already used by %s", name, other)
+		} else {
+			v.outputs[name] = out
+		}
+		if _, ok := names[name]; !ok {
+			names[name] = out
+		}
+
+		if o.Location == "" {
+			v.errs.add(out+".location", "missing location")
+		} else if u, err := url.Parse(o.Location); err != nil {
+			v.errs.add(out+".location", "invalid URL %q: %v", o.Location, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errs.add(out+".location", "invalid URL %q: expecting http(s)://host[:port]/", o.Location)
+		}
+
+		v.duration(out+".timeout", o.Timeout)
+		if !validPrecisions[o.Precision] {
+			v.errs.add(out+".precision", "invalid precision %q", o.Precision)
+		}
+		v.duration(out+".max-delay-interval", o.MaxDelayInterval)
+		v.nonNegative(out+".buffer-size-mb", o.BufferSizeMB)
+		v.nonNegative(out+".max-batch-kb", o.MaxBatchKB)
+		v.nonNegative(out+".max-attempts", o.MaxAttempts)
+		v.nonNegative(out+".drain-rate-kb", o.DrainRateKB)
+		v.nonNegative(out+".retry-workers", o.RetryWorkers)
+		v.duration(out+".retry-initial-interval", o.RetryInitialInterval)
+		if o.RetryMultiplier != 0 && o.RetryMultiplier < 1 {
+			v.errs.add(out+".retry-multiplier", "must be at least 1, got %v", o.RetryMultiplier)
+		}
+		v.duration(out+".max-age", o.MaxAge)
+		v.overflow(out, o)
+
+		switch o.Compression {
+		case "", CompressionNone, CompressionGzip:
+		default:
+			v.errs.add(out+".compression", "unknown compression %q, expecting %s or %s", o.Compression, CompressionNone, CompressionGzip)
+		}
+
+		if o.CompressionLevel != 0 && (o.CompressionLevel < 1 || o.CompressionLevel > 9) {
+			v.errs.add(out+".compression-level", "must be between 1 and 9, got %d", o.CompressionLevel)
+		}
+
+		v.circuitBreaker(out+".circuit-breaker", o.CircuitBreaker)
+
+		v.duration(out+".coalesce-linger", o.CoalesceLinger)
+		v.nonNegative(out+".coalesce-max-kb", o.CoalesceMaxKB)
+		if o.CoalesceMaxKB != 0 && o.CoalesceLinger == "" {
+			v.errs.add(out+".coalesce-max-kb", "requires coalesce-linger")
+		}
+	}
+
+	// The dead letter outputs may be defined after the outputs using them
+	for i, o := range r.Outputs {
+		v.deadLetter(fmt.Sprintf("%s.output[%d]", path, i), o, names)
+	}
+}
+
+func (v *validator) circuitBreaker(path string, b CircuitBreakerConfig) {
+	if b.FailureRatio < 0 || b.FailureRatio > 1 {
+		v.errs.add(path+".failure-ratio", "must be between 0 and 1, got %v", b.FailureRatio)
+	}
+
+	v.nonNegative(path+".min-requests", b.MinRequests)
+	v.duration(path+".window", b.Window)
+	v.duration(path+".open-duration", b.OpenDuration)
+	v.nonNegative(path+".half-open-probes", b.HalfOpenProbes)
+}
+
+func (v *validator) overflow(out string, o HTTPOutputConfig) {
+	switch o.OverflowPolicy {
+	case "", OverflowDropNewest, OverflowDropOldest:
+	case OverflowBlock:
+		v.duration(out+".overflow-timeout", o.OverflowTimeout)
+	case OverflowSpill:
+		if o.SpillPath == "" {
+			v.errs.add(out+".spill-path", "missing path")
+		}
+		v.nonNegative(out+".spill-size-mb", o.SpillSizeMB)
+	default:
+		v.errs.add(out+".overflow-policy", "unknown policy %q, expecting %s, %s, %s or %s", o.OverflowPolicy,
+			OverflowDropNewest, OverflowDropOldest, OverflowBlock, OverflowSpill)
+	}
+}
+
+func (v *validator) deadLetter(out string, o HTTPOutputConfig, outputs map[string]string) {
+	d := o.DeadLetter
+
+	if o.BufferSizeMB <= 0 {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"max-attempts", o.MaxAttempts != 0},
+			{"max-age", o.MaxAge != ""},
+			{"split-batches", o.SplitBatches},
+			{"dead-letter", d.Type != ""},
+			{"drain-before-passthrough", o.DrainBeforePassthrough},
+			{"drain-rate-kb", o.DrainRateKB != 0},
+			{"retry-workers", o.RetryWorkers != 0},
+			{"retry-initial-interval", o.RetryInitialInterval != ""},
+			{"retry-multiplier", o.RetryMultiplier != 0},
+			{"overflow-policy", o.OverflowPolicy != ""},
+			{"buffer-compression", o.BufferCompression},
+		} {
+			if option.set {
+				v.errs.add(out+"."+option.name, "requires buffer-size-mb")
+			}
+		}
+	}
+
+	path := out + ".dead-letter"
+	switch d.Type {
+	case "", DeadLetterMemory:
+	case DeadLetterFile:
+		if d.Path == "" {
+			v.errs.add(path+".path", "missing path")
+		}
+	case DeadLetterOutput:
+		name := o.Name
+		if name == "" {
+			name = o.Location
+		}
+
+		switch {
+		case d.Output == "":
+			v.errs.add(path+".output", "missing output")
+		case d.Output == name:
+			v.errs.add(path+".output", "output %q cannot be its own dead letter", d.Output)
+		case outputs[d.Output] == "":
+			v.errs.add(path+".output", "unknown output %q", d.Output)
+		}
+	default:
+		v.errs.add(path+".type", "unknown type %q, expecting %s, %s or %s", d.Type, DeadLetterMemory, DeadLetterFile, DeadLetterOutput)
+	}
+
+	v.nonNegative(path+".max-size-mb", d.MaxSizeMB)
+}
+
+func (v *validator) udpRelay(path string, r UDPConfig) {
+	v.relay(path, r.RelayName())
+	v.bind(path+".bind-addr", r.Addr)
+	v.nonNegative(path+".read-buffer", r.ReadBuffer)
+	v.logLevel(path+".log-level", r.LogLevel)
+
+	if !validPrecisions[r.Precision] {
+		v.errs.add(path+".precision", "invalid precision %q", r.Precision)
+	}
+
+	names := make(map[string]string)
+	for i, o := range r.Outputs {
+		out := fmt.Sprintf("%s.output[%d]", path, i)
+
+		name := o.Name
+		if name == "" {
+			name = o.Location
+		}
+
+		if other, ok := names[name]; ok {
+			v.errs.add(out+".name", "duplicate output name %q, already used by %s", name, other)
+		} else {
+			names[name] = out
+		}
+
+		if _, _, err := net.SplitHostPort(o.Location); err != nil {
+			v.errs.add(out+".location", "invalid address %q: %v", o.Location, err)
+		}
+
+		v.nonNegative(out+".mtu", o.MTU)
+	}
+}
+
+func (v *validator) filter(path string, f Filter) {
+	if _, err := regexp.Compile(f.TagExpression); err != nil {
+		v.errs.add(path+".tag-expression", "%v", err)
+	}
+
+	if _, err := regexp.Compile(f.MeasurementExpression); err != nil {
+		v.errs.add(path+".measurement-expression", "%v", err)
+	}
+
+	for i, o := range f.Outputs {
+		if v.outputs[o] == "" {
+			v.errs.add(fmt.Sprintf("%s.outputs[%d]", path, i), "unknown output %q", o)
+		}
+	}
+}
+
+func (v *validator) metrics(path string, m MetricsConfig) {
+	if m.Path != "" && !strings.HasPrefix(m.Path, "/") {
+		v.errs.add(path+".path", "must start with /, got %q", m.Path)
+	}
+
+	// The dedicated server only listens when the metrics are
+	// not served by the relays themselves
+	if m.IsEnabled() && !m.RelayListeners {
+		v.bind(path+".bind-addr", m.AddrOrDefault())
+	}
+}
+
+func (v *validator) monitor(path string, m MonitorConfig) {
+	if !m.Enabled {
+		return
+	}
+
+	v.duration(path+".interval", m.Interval)
+	if m.Interval != "" {
+		if d, err := time.ParseDuration(m.Interval); err == nil && d == 0 {
+			v.errs.add(path+".interval", "must not be zero")
+		}
+	}
+
+	if m.Output == "" {
+		v.errs.add(path+".output", "missing output")
+	} else if v.outputs[m.Output] == "" {
+		v.errs.add(path+".output", "unknown HTTP output %q", m.Output)
+	}
+}
+
+func (v *validator) tracing(path string, t TracingConfig) {
+	switch t.Exporter {
+	case "", TracingStdout:
+	case TracingOTLP:
+		if t.Endpoint == "" {
+			break
+		}
+
+		if u, err := url.Parse(t.Endpoint); err != nil {
+			v.errs.add(path+".endpoint", "invalid URL %q: %v", t.Endpoint, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errs.add(path+".endpoint", "invalid URL %q: expecting http(s)://host[:port]/path", t.Endpoint)
+		}
+	case TracingFile:
+		if t.File == "" {
+			v.errs.add(path+".file", "missing file")
+		}
+	default:
+		v.errs.add(path+".exporter", "unknown exporter %q, expecting %s, %s or %s", t.Exporter, TracingOTLP, TracingFile, TracingStdout)
+	}
+
+	if t.SampleRate < 0 || t.SampleRate > 1 {
+		v.errs.add(path+".sample-rate", "must be between 0 and 1, got %v", t.SampleRate)
+	}
+}
+
+func (v *validator) log(path string, l LogConfig) {
+	v.logLevel(path+".level", l.Level)
+
+	if l.Format != "" && l.Format != LogLogfmt && l.Format != LogJSON {
+		v.errs.add(path+".format", "unknown format %q, expecting %s or %s", l.Format, LogLogfmt, LogJSON)
+	}
+
+	v.nonNegative(path+".sample-first", l.SampleFirst)
+	v.duration(path+".sample-interval", l.SampleInterval)
+}
+
+// Validate performs semantic checks on the configuration, such as
+// duplicate names, invalid URLs or listeners bound to the same address
+// All the problems are reported at once as ValidationErrors
+func (c Config) Validate() error {
+	v := validator{
+		relays:  make(map[string]string),
+		outputs: make(map[string]string),
+	}
+
+	for i, r := range c.HTTPRelays {
+		v.httpRelay(fmt.Sprintf("http[%d]", i), r)
+	}
+
+	for i, r := range c.UDPRelays {
+		v.udpRelay(fmt.Sprintf("udp[%d]", i), r)
+	}
+
+	for i, f := range c.Filters {
+		v.filter(fmt.Sprintf("filter[%d]", i), f)
+	}
+
+	v.metrics("metrics", c.Metrics)
+	v.monitor("monitor", c.Monitor)
+	v.tracing("tracing", c.Tracing)
+	v.log("log", c.Log)
+
+	return v.errs.err()
+}
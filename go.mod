@@ -12,4 +12,5 @@ require (
 	github.com/stretchr/testify v1.4.0
 	go.opencensus.io v0.22.2
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,282 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// Level is the severity of a message
+type Level int8
+
+// Supported levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: config.LogDebug,
+	LevelInfo:  config.LogInfo,
+	LevelWarn:  config.LogWarn,
+	LevelError: config.LogError,
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level of the given name,
+// an empty name meaning the info level
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+
+	for l, n := range levelNames {
+		if n == strings.ToLower(name) {
+			return l, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// output is shared by a logger and all the loggers derived from it
+type output struct {
+	mu      sync.Mutex
+	w       io.Writer
+	json    bool
+	sampler *sampler
+}
+
+// Logger writes structured messages, as logfmt or JSON lines
+// Each message is made of its time, level, text and a list of
+// key/value pairs, the fields of the logger coming first
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+}
+
+// New creates a logger writing to w in the given format (logfmt or json)
+// Messages below level are discarded
+func New(w io.Writer, format string, level Level) *Logger {
+	return &Logger{
+		out:   &output{w: w, json: format == config.LogJSON},
+		level: level,
+	}
+}
+
+// FromConfig creates the logger described by the configuration,
+// the output being either stdout, stderr or a file
+func FromConfig(cfg config.LogConfig) (*Logger, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer
+	switch cfg.Output {
+	case "", config.LogStderr:
+		w = os.Stderr
+	case config.LogStdout:
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	l := New(w, cfg.Format, level)
+
+	if cfg.SampleFirst > 0 {
+		interval := config.DefaultLogSampleInterval
+		if cfg.SampleInterval != "" {
+			if interval, err = time.ParseDuration(cfg.SampleInterval); err != nil {
+				return nil, fmt.Errorf("error parsing log sample interval '%v'", err)
+			}
+		}
+
+		l.out.sampler = newSampler(interval, cfg.SampleFirst)
+	}
+
+	return l, nil
+}
+
+// With returns a logger adding the given key/value pairs to every message
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// WithLevel returns a logger discarding the messages below level
+func (l *Logger) WithLevel(level Level) *Logger {
+	return &Logger{out: l.out, level: level, fields: l.fields}
+}
+
+// Enabled tells whether the messages of the given level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes a debug message
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Info writes an informational message
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Warn writes a warning
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+// Error writes an error message
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	now := time.Now()
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+
+	// Only the warnings and errors are sampled, they are the
+	// messages repeated for every write when a backend is down
+	if s := l.out.sampler; s != nil && level >= LevelWarn {
+		ok, dropped := s.sample(sampleKey(level, msg, fields), now)
+		if !ok {
+			return
+		}
+
+		if dropped > 0 {
+			fields = append(fields, "sampled", dropped)
+		}
+	}
+
+	var buf bytes.Buffer
+	if l.out.json {
+		encodeJSON(&buf, now, level, msg, fields)
+	} else {
+		encodeLogfmt(&buf, now, level, msg, fields)
+	}
+
+	l.out.mu.Lock()
+	_, _ = l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+// value returns the representation of a field value
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return v
+}
+
+func encodeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	enc := func(v interface{}) {
+		data, err := json.Marshal(value(v))
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.Write(data)
+	}
+
+	buf.WriteString(`{"ts":`)
+	enc(now.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	enc(level.String())
+	buf.WriteString(`,"msg":`)
+	enc(msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		enc(fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		if i+1 < len(fields) {
+			enc(fields[i+1])
+		} else {
+			buf.WriteString("null")
+		}
+	}
+
+	buf.WriteString("}\n")
+}
+
+func encodeLogfmt(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString("ts=")
+	buf.WriteString(now.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtValue(msg))
+
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+		if i+1 < len(fields) {
+			buf.WriteString(logfmtValue(fmt.Sprint(value(fields[i+1]))))
+		}
+	}
+
+	buf.WriteByte('\n')
+}
+
+// logfmtValue quotes the values which would be ambiguous otherwise
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = New(os.Stderr, config.LogLogfmt, LevelInfo)
+)
+
+// Default returns the logger used by the relays
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultLogger
+}
+
+// SetDefault replaces the logger used by the relays
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defaultLogger = l
+	defaultMu.Unlock()
+}
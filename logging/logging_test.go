@@ -0,0 +1,186 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// lines returns the logged lines, without their time
+func lines(buf *bytes.Buffer) []string {
+	var res []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if l != "" {
+			res = append(res, l[strings.IndexByte(l, ' ')+1:])
+		}
+	}
+
+	return res
+}
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, config.LogLogfmt, LevelInfo).With("relay", "my relay")
+
+	l.Debug("hidden")
+	l.Info("started", "addr", ":9096")
+	l.With("backend", "b").Error("write failed", "error", errors.New(`bad "point"`), "duration", time.Second, "odd")
+
+	assert.Equal(t, []string{
+		`level=info msg=started relay="my relay" addr=:9096`,
+		`level=error msg="write failed" relay="my relay" backend=b error="bad \"point\"" duration=1s odd=`,
+	}, lines(&buf))
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, config.LogJSON, LevelDebug).With("relay", "r")
+	l.Debug("write forwarded", "bytes", 42, "error", errors.New("none"))
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotEmpty(t, m["ts"])
+	delete(m, "ts")
+	assert.Equal(t, map[string]interface{}{
+		"level": "debug",
+		"msg":   "write forwarded",
+		"relay": "r",
+		"bytes": float64(42),
+		"error": "none",
+	}, m)
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, config.LogLogfmt, LevelInfo)
+
+	l.WithLevel(LevelError).Warn("hidden")
+	l.WithLevel(LevelDebug).Debug("shown")
+	assert.Equal(t, []string{"level=debug msg=shown"}, lines(&buf))
+
+	level, err := ParseLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.EqualError(t, err, `unknown log level "verbose"`)
+}
+
+func TestSampling(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := FromConfig(config.LogConfig{Output: config.LogStdout, SampleFirst: 2, SampleInterval: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.out.w = &buf
+
+	now := time.Now()
+	s := l.out.sampler
+	for i := 0; i < 5; i++ {
+		l.Error("backend down", "backend", "a", "request_id", NewRequestID())
+	}
+	l.Error("backend down", "backend", "b")
+	l.Info("not sampled", "backend", "a")
+	l.Info("not sampled", "backend", "a")
+
+	// A new interval starts, the dropped messages are reported
+	for _, c := range s.counters {
+		c.start = now.Add(-2 * time.Hour)
+	}
+	l.Error("backend down", "backend", "a")
+
+	logged := lines(&buf)
+	assert.Equal(t, 6, len(logged))
+	assert.Contains(t, logged[2], "backend=b")
+	assert.Contains(t, logged[4], "not sampled")
+	assert.True(t, strings.HasSuffix(logged[5], "backend=a sampled=3"), logged[5])
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := WithRequestID(context.Background(), "42")
+	assert.Equal(t, "42", RequestID(ctx))
+	assert.Equal(t, "", RequestID(context.Background()))
+	assert.Len(t, NewRequestID(), 16)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logging")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := OpenRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	line := []byte(strings.Repeat("x", 1<<19-1) + "\n")
+	for i := 0; i < 7; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if assert.NoError(t, err) {
+			assert.True(t, info.Size() <= 1<<20, name)
+		}
+	}
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFileError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logging")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	// The backup cannot take the place of a directory
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	line := []byte(strings.Repeat("x", 1<<19-1) + "\n")
+	for i := 0; i < 2; i++ {
+		_, err = f.Write(line)
+		assert.NoError(t, err)
+	}
+
+	// The file keeps growing while it cannot be rotated
+	n, err := f.Write(line)
+	assert.Error(t, err)
+	assert.Equal(t, len(line), n)
+
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	_, err = f.Write(line)
+	assert.NoError(t, err)
+
+	for name, size := range map[string]int{path: len(line), path + ".1": 3 * len(line)} {
+		info, err := os.Stat(name)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(size), info.Size(), name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// RotatingFile is a file renamed to <path>.1 once it reaches its
+// maximum size, the previous backups being shifted in turn
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens the file at path for appending
+// A zero maxSizeMB disables the rotation
+func OpenRotatingFile(path string, maxSizeMB, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) << 20,
+		maxBackups: maxBackups,
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, size, err := openAppend(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.f, r.size = f, size
+	return nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+// Write appends p to the file, rotating it first if p would not fit
+// A file which cannot be rotated keeps growing, the error being returned
+// once p is written
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		rotateErr = r.rotate()
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate renames the file, the writes going on to the current file
+// until the new one is open
+func (r *RotatingFile) rotate() error {
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+
+	_ = os.Remove(backup(r.maxBackups))
+	for i := r.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(backup(i), backup(i+1))
+	}
+
+	if r.maxBackups > 0 {
+		if err := os.Rename(r.path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	f, size, err := openAppend(r.path)
+	if err != nil {
+		return err
+	}
+
+	_ = r.f.Close()
+	r.f, r.size = f, size
+	return nil
+}
+
+// Close closes the file
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+var (
+	filesMu sync.Mutex
+	files   = map[string]*RotatingFile{}
+)
+
+// OpenOutput returns the writer for stdout, stderr or the file at output,
+// the relays logging to the same file sharing a single writer
+func OpenOutput(output string, maxSizeMB, maxBackups int) (io.Writer, error) {
+	switch output {
+	case "", config.LogStdout:
+		return os.Stdout, nil
+	case config.LogStderr:
+		return os.Stderr, nil
+	}
+
+	filesMu.Lock()
+	defer filesMu.Unlock()
+
+	if f, ok := files[output]; ok {
+		return f, nil
+	}
+
+	f, err := OpenRotatingFile(output, maxSizeMB, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	files[output] = f
+	return f, nil
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sampledKeys are the fields identifying the source of a message
+// along with its level and text, other fields such as the request
+// IDs vary between otherwise identical messages
+var sampledKeys = map[string]bool{
+	"relay":   true,
+	"backend": true,
+}
+
+func sampleKey(level Level, msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		if k, ok := fields[i].(string); ok && sampledKeys[k] {
+			fmt.Fprintf(&b, " %s=%v", k, fields[i+1])
+		}
+	}
+
+	return b.String()
+}
+
+type sampleCounter struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+// sampler lets through the first messages of each key during an
+// interval and drops the next ones, the number of dropped messages
+// is reported by the first message let through afterwards
+type sampler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	first    int
+	counters map[string]*sampleCounter
+}
+
+func newSampler(interval time.Duration, first int) *sampler {
+	return &sampler{
+		interval: interval,
+		first:    first,
+		counters: make(map[string]*sampleCounter),
+	}
+}
+
+// sample tells whether the message has to be written, and how many
+// similar messages have been dropped since the last one written
+func (s *sampler) sample(key string, now time.Time) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok {
+		c = &sampleCounter{start: now}
+		s.counters[key] = c
+	}
+
+	if now.Sub(c.start) >= s.interval {
+		c.start = now
+		c.count = 0
+	}
+
+	c.count++
+	if c.count > s.first {
+		c.dropped++
+		return false, 0
+	}
+
+	dropped := c.dropped
+	c.dropped = 0
+	return true, dropped
+}
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 
 	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
 	"github.com/strike-team/influxdb-relay/relayservice"
 )
 
@@ -18,12 +19,21 @@ const (
 var (
 	usage = func() {
 		fmt.Println("Please, see README for more information about InfluxDB Relay...")
+		fmt.Println()
+		fmt.Println("Usage: influxdb-relay [options]")
+		fmt.Println("       influxdb-relay check -config file")
+		fmt.Println("       influxdb-relay dump -config file")
+		fmt.Println("       influxdb-relay route -config file < points.lp")
+		fmt.Println("       influxdb-relay replay [options] file [file...]")
+		fmt.Println()
 		flag.PrintDefaults()
 	}
 
-	configFile  = flag.String("config", "", "Configuration file to use")
-	verbose     = flag.Bool("v", false, "If set, InfluxDB Relay will log HTTP requests")
-	versionFlag = flag.Bool("version", false, "Print current InfluxDB Relay version")
+	configFile   = flag.String("config", "", "Configuration file to use")
+	configFormat = flag.String("config-format", "", "Format of the configuration file (toml, yaml or json), guessed from the extension by default")
+	configDir    = flag.String("config-dir", "", "Directory of configuration fragments merged with the configuration file")
+	verbose      = flag.Bool("v", false, "If set, InfluxDB Relay logs at the debug level, unless another level is configured")
+	versionFlag  = flag.Bool("version", false, "Print current InfluxDB Relay version")
 )
 
 func runRelay(cfg config.Config) {
@@ -40,11 +50,29 @@ func runRelay(cfg config.Config) {
 		relay.Stop()
 	}()
 
-	log.Println("starting relays...")
+	logging.Default().Info("starting relays", "version", relayVersion)
 	relay.Run()
 }
 
 func main() {
+	// Subcommands have their own set of flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "dump":
+			runDump(os.Args[2:])
+			return
+		case "route":
+			runRoute(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -53,15 +81,15 @@ func main() {
 		return
 	}
 
-	// Configuration file is mandatory
-	if *configFile == "" {
+	// Configuration file or directory is mandatory
+	if *configFile == "" && *configDir == "" {
 		fmt.Fprintln(os.Stderr, "Missing configuration file")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
 	// And it has to be loaded in order to continue
-	cfg, err := config.LoadConfigFile(*configFile)
+	cfg, err := config.LoadConfig(*configFile, *configFormat, *configDir)
 	if err != nil {
 		log.Println("Version: " + relayVersion)
 		log.Fatal(err.Error())
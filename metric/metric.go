@@ -3,32 +3,67 @@ package metric
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	ocprom "contrib.go.opencensus.io/exporter/prometheus"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
 	"go.opencensus.io/stats/view"
+
+	"github.com/strike-team/influxdb-relay/config"
 )
 
 const (
-	defaultAddr              = ":8088"
 	defaultShutdownTimeoutMs = 5000
 )
 
+var (
+	exporter     *ocprom.Exporter
+	exporterErr  error
+	exporterOnce sync.Once
+)
+
+// Handler returns the http.Handler serving the metrics in the Prometheus format
+// The exporter uses its own registry, along with the Go runtime and process
+// metrics, it is created and registered on first use
+func Handler() (http.Handler, error) {
+	exporterOnce.Do(func() {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		)
+		exporter, exporterErr = ocprom.NewExporter(
+			ocprom.Options{
+				Registerer: registry,
+				Gatherer:   registry,
+			})
+		if exporterErr == nil {
+			view.RegisterExporter(exporter)
+		}
+	})
+
+	return exporter, exporterErr
+}
+
 // Server represents a metric server serves /metrics endpoint
 type Server struct {
-	h  *http.Server
-	pe *ocprom.Exporter
+	h    *http.Server
+	cert string
 }
 
 // Run launchs the metric server
 func (s *Server) Run() error {
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", s.pe)
+	var err error
+	if s.cert != "" {
+		err = s.h.ListenAndServeTLS(s.cert, s.cert)
+	} else {
+		err = s.h.ListenAndServe()
+	}
 
-	s.h.Handler = mux
-	if err := s.h.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
@@ -42,33 +77,36 @@ func (s *Server) Stop() error {
 }
 
 // NewServer returns a metric server
-func NewServer() (*Server, error) {
-	promExporter, err := ocprom.NewExporter(
-		ocprom.Options{
-			Registerer: prometheus.DefaultRegisterer,
-			Gatherer:   prometheus.DefaultGatherer,
-		})
+// Omitted settings are replaced by their default values
+func NewServer(cfg config.MetricsConfig) (*Server, error) {
+	handler, err := Handler()
 	if err != nil {
 		return nil, err
 	}
-	view.RegisterExporter(promExporter)
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.PathOrDefault(), handler)
 
 	return &Server{
-		h:  &http.Server{Addr: defaultAddr},
-		pe: promExporter,
+		h:    &http.Server{Addr: cfg.AddrOrDefault(), Handler: mux},
+		cert: cfg.SSLCombinedPem,
 	}, nil
 }
 
 // HTTPHandler returns a http.Handler wrapper that instruments given HTTP server's handler
+// The trace context of the incoming requests is read from the W3C traceparent header
 func HTTPHandler(h http.Handler) http.Handler {
 	return &ochttp.Handler{
-		Handler: h,
+		Handler:     h,
+		Propagation: &tracecontext.HTTPFormat{},
 	}
 }
 
 // HTTPTransport returns a http.RoundTripper wrapper that instruments all outgoing requests from base
+// The trace context is propagated to the backends with the W3C traceparent header
 func HTTPTransport(base *http.Transport) http.RoundTripper {
 	return &ochttp.Transport{
-		Base: base,
+		Base:        base,
+		Propagation: &tracecontext.HTTPFormat{},
 	}
 }
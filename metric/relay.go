@@ -0,0 +1,249 @@
+package metric
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Tags used by the relay specific measures
+var (
+	KeyRelay    = tag.MustNewKey("relay")
+	KeyBackend  = tag.MustNewKey("backend")
+	KeyDatabase = tag.MustNewKey("database")
+)
+
+// Relay specific measures
+var (
+	PointsReceived = stats.Int64("relay/points/received", "Number of points received", stats.UnitDimensionless)
+	PointsFiltered = stats.Int64("relay/points/filtered", "Number of points not forwarded to a backend because of its filters", stats.UnitDimensionless)
+
+	BufferSize    = stats.Int64("relay/buffer/size", "Size of the data held in the retry buffer", stats.UnitBytes)
+	BufferBatches = stats.Int64("relay/buffer/batches", "Number of batches held in the retry buffer", stats.UnitDimensionless)
+	BufferAge     = stats.Float64("relay/buffer/oldest_age", "Age of the oldest batch held in the retry buffer", "s")
+	BufferDropped = stats.Int64("relay/buffer/dropped", "Size of the writes dropped because the retry buffer is full", stats.UnitBytes)
+	BufferGivenUp = stats.Int64("relay/buffer/given_up", "Size of the batches given up by the retry buffer", stats.UnitBytes)
+
+	CircuitState    = stats.Int64("relay/circuit/state", "State of the circuit breaker of a backend: 0 closed, 1 half-open, 2 open", stats.UnitDimensionless)
+	CircuitOpened   = stats.Int64("relay/circuit/opened", "Number of times the circuit breaker of a backend opened", stats.UnitDimensionless)
+	CircuitRejected = stats.Int64("relay/circuit/rejected", "Size of the writes not sent because the circuit breaker of a backend is open", stats.UnitBytes)
+
+	AsyncQueueSize = stats.Int64("relay/async/queue_size", "Size of the writes acknowledged and not sent yet to a backend", stats.UnitBytes)
+	AsyncFailed    = stats.Int64("relay/async/failed", "Size of the acknowledged writes which could not be sent to a backend", stats.UnitBytes)
+	AsyncSync      = stats.Int64("relay/async/sync", "Number of writes acknowledged once sent because a queue is above its watermark", stats.UnitDimensionless)
+
+	UDPParseErrors = stats.Int64("relay/udp/parse_errors", "Number of UDP packets which could not be parsed", stats.UnitDimensionless)
+)
+
+var (
+	relayViews = []*view.View{
+		&view.View{
+			Name:        "relay/points/received",
+			Description: "Count of points received, by relay and database",
+			TagKeys:     []tag.Key{KeyRelay, KeyDatabase},
+			Measure:     PointsReceived,
+			Aggregation: view.Sum(),
+		},
+		&view.View{
+			Name:        "relay/points/filtered",
+			Description: "Count of points rejected by the filters of a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     PointsFiltered,
+			Aggregation: view.Sum(),
+		},
+		&view.View{
+			Name:        "relay/buffer/size_bytes",
+			Description: "Current size of the retry buffer of a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferSize,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Name:        "relay/buffer/batches",
+			Description: "Current number of batches in the retry buffer of a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferBatches,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Name:        "relay/buffer/oldest_age_seconds",
+			Description: "Age of the oldest batch in the retry buffer of a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferAge,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Name:        "relay/buffer/dropped_count",
+			Description: "Count of writes dropped because the retry buffer of a backend is full",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferDropped,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "relay/buffer/dropped_bytes",
+			Description: "Size of the writes dropped because the retry buffer of a backend is full",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferDropped,
+			Aggregation: view.Sum(),
+		},
+		&view.View{
+			Name:        "relay/buffer/given_up_count",
+			Description: "Count of batches out of attempts or too old, moved to the dead letter of a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferGivenUp,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "relay/buffer/given_up_bytes",
+			Description: "Size of the batches out of attempts or too old, moved to the dead letter of a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     BufferGivenUp,
+			Aggregation: view.Sum(),
+		},
+		&view.View{
+			Name:        "relay/circuit/state",
+			Description: "Current state of the circuit breaker of a backend: 0 closed, 1 half-open, 2 open",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     CircuitState,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Name:        "relay/circuit/opened_count",
+			Description: "Count of times the circuit breaker of a backend opened",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     CircuitOpened,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "relay/circuit/rejected_count",
+			Description: "Count of writes not sent because the circuit breaker of a backend is open",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     CircuitRejected,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "relay/async/queue_size_bytes",
+			Description: "Current size of the writes acknowledged and not sent yet to a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     AsyncQueueSize,
+			Aggregation: view.LastValue(),
+		},
+		&view.View{
+			Name:        "relay/async/failed_count",
+			Description: "Count of acknowledged writes which could not be sent to a backend",
+			TagKeys:     []tag.Key{KeyRelay, KeyBackend},
+			Measure:     AsyncFailed,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "relay/async/sync_count",
+			Description: "Count of writes acknowledged once sent because a queue is above its high watermark",
+			TagKeys:     []tag.Key{KeyRelay},
+			Measure:     AsyncSync,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Name:        "relay/udp/parse_errors",
+			Description: "Count of UDP packets which could not be parsed",
+			TagKeys:     []tag.Key{KeyRelay},
+			Measure:     UDPParseErrors,
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+func init() {
+	view.Register(relayViews...)
+}
+
+// RecordPointsReceived records points received by a relay for a database
+func RecordPointsReceived(relay, database string, n int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyDatabase, database)},
+		PointsReceived.M(int64(n)))
+}
+
+// RecordPointsFiltered records points which have not been sent to a backend
+// because they did not match its filters
+func RecordPointsFiltered(relay, backend string, n int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		PointsFiltered.M(int64(n)))
+}
+
+// RecordBufferState records the state of the retry buffer of a backend
+func RecordBufferState(relay, backend string, size, batches int, oldest time.Duration) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		BufferSize.M(int64(size)), BufferBatches.M(int64(batches)), BufferAge.M(oldest.Seconds()))
+}
+
+// RecordBufferDropped records a write of the given size dropped
+// because the retry buffer of a backend is full
+func RecordBufferDropped(relay, backend string, size int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		BufferDropped.M(int64(size)))
+}
+
+// RecordBufferGivenUp records a batch of the given size given up
+// by the retry buffer of a backend
+func RecordBufferGivenUp(relay, backend string, size int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		BufferGivenUp.M(int64(size)))
+}
+
+// RecordCircuitState records the state of the circuit breaker of a backend,
+// counting the times it opened
+func RecordCircuitState(relay, backend string, state int, opened bool) {
+	ms := []stats.Measurement{CircuitState.M(int64(state))}
+	if opened {
+		ms = append(ms, CircuitOpened.M(1))
+	}
+
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		ms...)
+}
+
+// RecordCircuitRejected records a write of the given size not sent
+// because the circuit breaker of a backend is open
+func RecordCircuitRejected(relay, backend string, size int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		CircuitRejected.M(int64(size)))
+}
+
+// RecordAsyncQueueSize records the size of the writes queued for a backend
+func RecordAsyncQueueSize(relay, backend string, size int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		AsyncQueueSize.M(int64(size)))
+}
+
+// RecordAsyncFailed records an acknowledged write of the given size
+// which could not be sent to a backend
+func RecordAsyncFailed(relay, backend string, size int) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay), tag.Upsert(KeyBackend, backend)},
+		AsyncFailed.M(int64(size)))
+}
+
+// RecordAsyncSync records a write acknowledged once sent
+// because a queue of the relay is above its high watermark
+func RecordAsyncSync(relay string) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay)},
+		AsyncSync.M(1))
+}
+
+// RecordUDPParseError records an UDP packet which could not be parsed
+func RecordUDPParseError(relay string) {
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(KeyRelay, relay)},
+		UDPParseErrors.M(1))
+}
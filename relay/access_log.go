@@ -0,0 +1,299 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+)
+
+// accessLog writes a line per request received by a relay
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+func newAccessLog(cfg config.AccessLogConfig) (*accessLog, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	w, err := logging.OpenOutput(cfg.Output, cfg.MaxSizeMB, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = config.AccessLogCombined
+	}
+
+	return &accessLog{w: w, format: format}, nil
+}
+
+// accessEntry holds what is logged about a request, the backends
+// report whether they accepted the write once the handler returned
+type accessEntry struct {
+	time      time.Time
+	client    string
+	user      string
+	method    string
+	uri       string
+	proto     string
+	referer   string
+	userAgent string
+	requestID string
+	status    int
+	bytes     int
+	duration  time.Duration
+
+	mu       sync.Mutex
+	points   int
+	backends []string
+
+	// pending is released once all the backends answered
+	pending sync.WaitGroup
+}
+
+type accessEntryKey struct{}
+
+func withAccessEntry(ctx context.Context, e *accessEntry) context.Context {
+	return context.WithValue(ctx, accessEntryKey{}, e)
+}
+
+// accessEntryFrom returns the entry of the request, nil when the access log is disabled
+func accessEntryFrom(ctx context.Context) *accessEntry {
+	e, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return e
+}
+
+func (e *accessEntry) setPoints(n int) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.points = n
+	e.mu.Unlock()
+}
+
+// accepted records a backend which accepted the write
+func (e *accessEntry) accepted(backend string) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	e.backends = append(e.backends, backend)
+	e.mu.Unlock()
+}
+
+// hold delays the entry until release is called
+func (e *accessEntry) hold() {
+	if e != nil {
+		e.pending.Add(1)
+	}
+}
+
+func (e *accessEntry) release() {
+	if e != nil {
+		e.pending.Done()
+	}
+}
+
+// accessWriter records the status and size of a response
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func newAccessEntry(r *http.Request, start time.Time) *accessEntry {
+	e := &accessEntry{
+		time:      start,
+		client:    r.RemoteAddr,
+		method:    r.Method,
+		uri:       r.URL.RequestURI(),
+		proto:     r.Proto,
+		referer:   r.Referer(),
+		userAgent: r.UserAgent(),
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.client = host
+	}
+
+	// Same as InfluxDB, the user is taken from the basic auth or the query string
+	if user, _, ok := r.BasicAuth(); ok {
+		e.user = user
+	} else {
+		e.user = r.URL.Query().Get("u")
+	}
+
+	// Keep the password out of the log
+	if q := r.URL.Query(); q.Get("p") != "" {
+		q.Set("p", "[REDACTED]")
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		e.uri = u.RequestURI()
+	}
+
+	return e
+}
+
+// write waits for the backends to answer, then writes the entry
+func (l *accessLog) write(e *accessEntry) {
+	e.pending.Wait()
+
+	var buf bytes.Buffer
+	if l.format == config.AccessLogJSON {
+		e.encodeJSON(&buf)
+	} else {
+		e.encodeCommon(&buf, l.format == config.AccessLogCombined)
+	}
+
+	l.mu.Lock()
+	_, _ = l.w.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+// dash is the value of the empty fields of the common log format
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// encodeCommon writes the entry in the Common (or Combined) Log Format,
+// followed by the duration in microseconds, the number of points,
+// the backends which accepted the write and the request ID
+func (e *accessEntry) encodeCommon(buf *bytes.Buffer, combined bool) {
+	buf.WriteString(dash(e.client))
+	buf.WriteString(" - ")
+	buf.WriteString(dash(e.user))
+	buf.WriteString(" [")
+	buf.WriteString(e.time.Format("02/Jan/2006:15:04:05 -0700"))
+	buf.WriteString("] ")
+	buf.WriteString(strconv.Quote(e.method + " " + e.uri + " " + e.proto))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(e.status))
+	buf.WriteByte(' ')
+	if e.bytes == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteString(strconv.Itoa(e.bytes))
+	}
+
+	if combined {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Quote(dash(e.referer)))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Quote(dash(e.userAgent)))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(e.duration.Microseconds(), 10))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(e.points))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Quote(dash(strings.Join(e.backends, ","))))
+	buf.WriteByte(' ')
+	buf.WriteString(dash(e.requestID))
+	buf.WriteByte('\n')
+}
+
+func (e *accessEntry) encodeJSON(buf *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	backends := e.backends
+	if backends == nil {
+		backends = []string{}
+	}
+
+	_ = json.NewEncoder(buf).Encode(struct {
+		Time       string   `json:"time"`
+		Client     string   `json:"client"`
+		User       string   `json:"user,omitempty"`
+		Method     string   `json:"method"`
+		URI        string   `json:"uri"`
+		Proto      string   `json:"proto"`
+		Status     int      `json:"status"`
+		Bytes      int      `json:"bytes"`
+		DurationUs int64    `json:"duration_us"`
+		Points     int      `json:"points"`
+		Backends   []string `json:"backends"`
+		Referer    string   `json:"referer,omitempty"`
+		UserAgent  string   `json:"user_agent,omitempty"`
+		RequestID  string   `json:"request_id,omitempty"`
+	}{
+		Time:       e.time.UTC().Format(time.RFC3339Nano),
+		Client:     e.client,
+		User:       e.user,
+		Method:     e.method,
+		URI:        e.uri,
+		Proto:      e.proto,
+		Status:     e.status,
+		Bytes:      e.bytes,
+		DurationUs: e.duration.Microseconds(),
+		Points:     e.points,
+		Backends:   backends,
+		Referer:    e.referer,
+		UserAgent:  e.userAgent,
+		RequestID:  e.requestID,
+	})
+}
+
+func (h *HTTP) accessLogMiddleware(next relayHandlerFunc) relayHandlerFunc {
+	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
+		if h.accessLog == nil {
+			next(h, w, r, start)
+			return
+		}
+
+		e := newAccessEntry(r, start)
+		aw := &accessWriter{ResponseWriter: w}
+
+		next(h, aw, r.WithContext(withAccessEntry(r.Context(), e)), start)
+
+		e.duration = time.Since(start)
+		e.status = aw.status
+		if e.status == 0 {
+			e.status = http.StatusOK
+		}
+		e.bytes = aw.bytes
+		e.requestID = w.Header().Get(logging.RequestIDHeader)
+
+		go h.accessLog.write(e)
+	})
+}
@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// lineWriter sends each written line on a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func accessLogged(t *testing.T, format string) string {
+	accepting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer accepting.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name: "logged",
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "up", Location: accepting.URL},
+			{Name: "down", Location: failing.URL},
+		},
+	}, false)
+
+	lines := make(lineWriter, 1)
+	h.accessLog = &accessLog{w: lines, format: format}
+
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test&u=bob&p=secret", bytes.NewBufferString("cpu value=1\ncpu value=2\n"))
+	r.Header.Set("User-Agent", "telegraf")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access log written")
+		return ""
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	line := accessLogged(t, config.AccessLogCombined)
+
+	assert.Regexp(t, regexp.MustCompile(
+		`^192\.0\.2\.1 - bob \[[^\]]+\] "POST /write\?db=test&p=%5BREDACTED%5D&u=bob HTTP/1\.1" 204 - "-" "telegraf" \d+ 2 "up" [0-9a-f]{16}\n$`,
+	), line)
+}
+
+func TestAccessLogCommon(t *testing.T) {
+	line := accessLogged(t, config.AccessLogCommon)
+
+	assert.Regexp(t, regexp.MustCompile(`^192\.0\.2\.1 - bob \[[^\]]+\] "POST [^"]+" 204 - \d+ 2 "up" `), line)
+	assert.NotContains(t, line, "secret")
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(accessLogged(t, config.AccessLogJSON)), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "192.0.2.1", entry["client"])
+	assert.Equal(t, "bob", entry["user"])
+	assert.Equal(t, "POST", entry["method"])
+	assert.Equal(t, float64(http.StatusNoContent), entry["status"])
+	assert.Equal(t, float64(2), entry["points"])
+	assert.Equal(t, []interface{}{"up"}, entry["backends"])
+	assert.Equal(t, "telegraf", entry["user_agent"])
+	assert.NotEmpty(t, entry["request_id"])
+}
@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+	"github.com/strike-team/influxdb-relay/metric"
+	"github.com/strike-team/influxdb-relay/tracing"
+)
+
+// ackQueue holds the writes of a backend which were acknowledged before
+// being sent, its senders send them by batches in the background
+type ackQueue struct {
+	list *bufferList
+
+	// above high bytes, the relay acknowledges the writes once sent,
+	// until every queue is back below low bytes
+	high int
+	low  int
+
+	b      *httpBackend
+	logger *logging.Logger
+}
+
+func newAckQueue(cfg config.AsyncAckConfig, b *httpBackend) *ackQueue {
+	size := config.DefaultAckQueueSizeMB * MB
+	if cfg.QueueSizeMB > 0 {
+		size = cfg.QueueSizeMB * MB
+	}
+
+	batch := DefaultBatchSizeKB * KB
+	if cfg.MaxBatchKB > 0 {
+		batch = cfg.MaxBatchKB * KB
+	}
+
+	high, low := cfg.HighWatermark, cfg.LowWatermark
+	if high == 0 {
+		high = config.DefaultHighWatermark
+	}
+	if low == 0 {
+		low = config.DefaultLowWatermark
+	}
+
+	return &ackQueue{
+		list:   newBufferList(size, batch),
+		high:   int(high * float64(size)),
+		low:    int(low * float64(size)),
+		b:      b,
+		logger: logging.Default().With("relay", b.relay, "backend", b.name),
+	}
+}
+
+// start runs n more senders
+func (q *ackQueue) start(n int) {
+	for i := 0; i < n; i++ {
+		go q.run()
+	}
+}
+
+// enqueue adds a write to the queue, buf may be shared with
+// the other queues but must not be modified afterwards
+func (q *ackQueue) enqueue(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*batch, error) {
+	b, err := q.list.add(ctx, buf, query, auth, endpoint)
+	q.recordState()
+	return b, err
+}
+
+// size returns the size of the writes waiting in the queue
+func (q *ackQueue) size() int {
+	size, _, _ := q.list.state()
+	return size
+}
+
+func (q *ackQueue) recordState() {
+	metric.RecordAsyncQueueSize(q.b.relay, q.b.name, q.size())
+}
+
+func (q *ackQueue) run() {
+	buf := bytes.NewBuffer(make([]byte, 0, q.list.maxBatch))
+	for {
+		buf.Reset()
+		b := q.list.pop()
+		q.recordState()
+
+		// The queued writes are neither compressed nor spilled
+		_ = b.load(buf)
+
+		// The batches the backend fails to take go to its retry buffer,
+		// if any, the ones failing here are dropped
+		resp, err := q.send(b, buf.Bytes())
+		switch {
+		case err != nil:
+			metric.RecordAsyncFailed(q.b.relay, q.b.name, b.size)
+			q.logger.Error("unable to send acknowledged writes", "request_ids", strings.Join(b.requestIDs, ","),
+				"bytes", b.size, "error", err)
+			resp = nil
+		case resp.StatusCode/100 != 2:
+			metric.RecordAsyncFailed(q.b.relay, q.b.name, b.size)
+			q.logger.Error("acknowledged writes rejected by backend", "request_ids", strings.Join(b.requestIDs, ","),
+				"bytes", b.size, "status", resp.StatusCode)
+		}
+
+		b.resp = resp
+		q.list.done(b)
+		b.wg.Done()
+	}
+}
+
+// send posts a batch of the queue, in a span of the traces of its writes
+func (q *ackQueue) send(b *batch, buf []byte) (*responseData, error) {
+	ctx, span := b.startSpan(tracing.SpanQueue)
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("relay", q.b.relay),
+		trace.StringAttribute("backend", q.b.name),
+		trace.Int64Attribute("writes", int64(len(b.bufs))),
+		trace.Int64Attribute("bytes", int64(len(buf))),
+	)
+
+	resp, err := q.b.post(ctx, buf, b.query, b.auth, b.endpoint)
+	tracing.SetResponse(span, statusCode(resp), err)
+
+	return resp, err
+}
+
+// asyncAck tells whether the writes are acknowledged before being sent,
+// they are acknowledged once sent from the time a queue goes above its high
+// watermark until every queue is back below its low watermark
+func (h *HTTP) asyncAck() bool {
+	if atomic.LoadInt32(&h.ackSync) == 0 {
+		for _, b := range h.backends {
+			if b.queue == nil || b.queue.size() < b.queue.high {
+				continue
+			}
+
+			if atomic.CompareAndSwapInt32(&h.ackSync, 0, 1) {
+				h.logger.Warn("queue above its high watermark, acknowledging the writes once sent", "backend", b.name)
+			}
+			return false
+		}
+
+		return true
+	}
+
+	for _, b := range h.backends {
+		if b.queue != nil && b.queue.size() > b.queue.low {
+			return false
+		}
+	}
+
+	if atomic.CompareAndSwapInt32(&h.ackSync, 1, 0) {
+		h.logger.Info("queues below their low watermark, acknowledging the writes at once")
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/metric"
+)
+
+func TestAsyncAck(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name:     "async",
+		Outputs:  []config.HTTPOutputConfig{{Name: "influx", Location: backend.URL}},
+		AsyncAck: config.AsyncAckConfig{Enabled: true},
+	}, false)
+
+	// The write is acknowledged while the backend does not answer
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewBufferString("cpu value=1 1\n"))
+	rec := httptest.NewRecorder()
+	metric.HTTPHandler(h).ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	close(release)
+	assert.Equal(t, "cpu value=1 1\n", <-received)
+
+	q := h.backends[0].queue
+	waitFor(t, func() bool { return q.list.drained() })
+}
+
+func TestAsyncAckBuffered(t *testing.T) {
+	var calls int32
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name: "async",
+		Outputs: []config.HTTPOutputConfig{{
+			Name:                 "influx",
+			Location:             backend.URL,
+			BufferSizeMB:         1,
+			MaxDelayInterval:     "10ms",
+			RetryInitialInterval: "1ms",
+		}},
+		AsyncAck: config.AsyncAckConfig{Enabled: true},
+	}, false)
+
+	// The acknowledged write the backend fails to take is retried
+	// from the retry buffer of the output
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewBufferString("cpu value=1 1\n"))
+	rec := httptest.NewRecorder()
+	metric.HTTPHandler(h).ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	assert.Equal(t, "cpu value=1 1\n", <-received)
+	waitFor(t, func() bool { return h.backends[0].getRetryBuffer().list.drained() })
+}
+
+func TestAsyncAckWatermark(t *testing.T) {
+	h := createHTTP(t, emptyConfig, false)
+
+	b, err := newHTTPBackend(&config.HTTPOutputConfig{Name: "influx", Location: ValidServer.URL}, h.Name(), config.Filters{})
+	assert.NoError(t, err)
+
+	// No sender, so that the queue only empties when popped
+	b.queue = newAckQueue(config.AsyncAckConfig{QueueSizeMB: 1, HighWatermark: 0.5, LowWatermark: 0.25}, b)
+	h.backends = append(h.backends, b)
+
+	write := make([]byte, 300*KB)
+	_, err = b.queue.enqueue(context.Background(), write, "db=test", "", "/write")
+	assert.NoError(t, err)
+	assert.True(t, h.asyncAck())
+
+	_, err = b.queue.enqueue(context.Background(), write, "db=test", "", "/write")
+	assert.NoError(t, err)
+	assert.False(t, h.asyncAck())
+
+	// Back below the high watermark, but still above the low one
+	b.queue.list.done(b.queue.list.pop())
+	assert.False(t, h.asyncAck())
+
+	b.queue.list.done(b.queue.list.pop())
+	assert.True(t, h.asyncAck())
+}
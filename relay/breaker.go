@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+	"github.com/strike-team/influxdb-relay/metric"
+)
+
+// ErrCircuitOpen error indicates that a write was not sent because
+// the circuit breaker of the backend is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// States of a circuit breaker, the values are the ones of the metric
+const (
+	circuitClosed = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+var circuitStates = []string{"closed", "half-open", "open"}
+
+// circuitBreaker opens once too many writes failed in a window, no write is
+// sent while it is open, then a few probes are sent to close it again
+type circuitBreaker struct {
+	mu    sync.Mutex
+	state int
+
+	failureRatio float64
+	minRequests  int
+	window       time.Duration
+	openDuration time.Duration
+	probes       int
+
+	// writes and failures of the current window, when closed
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	// openedAt is when the circuit last opened
+	openedAt time.Time
+
+	// probes in flight and succeeded, when half open
+	inFlight  int
+	succeeded int
+
+	// relay and backend names, used to tag metrics
+	relay   string
+	backend string
+
+	logger *logging.Logger
+}
+
+func newCircuitBreaker(cfg config.CircuitBreakerConfig, relay, backend string) (*circuitBreaker, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	b := &circuitBreaker{
+		failureRatio: cfg.FailureRatio,
+		minRequests:  cfg.MinRequests,
+		window:       config.DefaultBreakerWindow,
+		openDuration: config.DefaultOpenDuration,
+		probes:       cfg.HalfOpenProbes,
+		relay:        relay,
+		backend:      backend,
+		logger:       logging.Default().With("relay", relay, "backend", backend),
+	}
+
+	if b.failureRatio == 0 {
+		b.failureRatio = config.DefaultFailureRatio
+	}
+
+	if b.minRequests == 0 {
+		b.minRequests = config.DefaultMinRequests
+	}
+
+	if b.probes == 0 {
+		b.probes = config.DefaultHalfOpenProbes
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"window", cfg.Window, &b.window},
+		{"open duration", cfg.OpenDuration, &b.openDuration},
+	} {
+		if d.value == "" {
+			continue
+		}
+
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing circuit breaker %s %v", d.name, err)
+		}
+		*d.dst = v
+	}
+
+	metric.RecordCircuitState(relay, backend, circuitClosed, false)
+	return b, nil
+}
+
+// allow tells whether a write can be sent, and whether it is a probe
+// of a half open circuit
+func (b *circuitBreaker) allow() (ok bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen {
+		if time.Since(b.openedAt) < b.openDuration {
+			return false, false
+		}
+		b.setState(circuitHalfOpen)
+	}
+
+	if b.state == circuitHalfOpen {
+		if b.inFlight+b.succeeded >= b.probes {
+			return false, false
+		}
+		b.inFlight++
+		return true, true
+	}
+
+	return true, false
+}
+
+// record counts the outcome of a write allowed by the breaker
+func (b *circuitBreaker) record(success bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case probe && b.state == circuitHalfOpen:
+		b.inFlight--
+		if !success {
+			b.setState(circuitOpen)
+			return
+		}
+
+		if b.succeeded++; b.succeeded >= b.probes {
+			b.setState(circuitClosed)
+		}
+
+	case !probe && b.state == circuitClosed:
+		if now := time.Now(); now.Sub(b.windowStart) >= b.window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+
+		b.requests++
+		if !success {
+			b.failures++
+		}
+
+		if b.requests >= b.minRequests && float64(b.failures) >= b.failureRatio*float64(b.requests) {
+			b.setState(circuitOpen)
+		}
+	}
+}
+
+// setState moves the breaker into a new state, the lock being held
+func (b *circuitBreaker) setState(state int) {
+	switch state {
+	case circuitOpen:
+		b.openedAt = time.Now()
+		b.logger.Warn("circuit breaker open, not sending writes", "failures", b.failures, "requests", b.requests,
+			"open_duration", b.openDuration)
+	case circuitHalfOpen:
+		b.inFlight, b.succeeded = 0, 0
+		b.logger.Info("circuit breaker half open, probing backend")
+	case circuitClosed:
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+		b.logger.Info("circuit breaker closed, sending writes")
+	}
+
+	b.state = state
+	metric.RecordCircuitState(b.relay, b.backend, state, state == circuitOpen)
+}
+
+// openFor returns how long the circuit stays open, zero if it is not
+func (b *circuitBreaker) openFor() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitOpen {
+		return 0
+	}
+
+	if d := b.openDuration - time.Since(b.openedAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// stateName returns the name of the current state of the breaker
+func (b *circuitBreaker) stateName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return circuitStates[b.state]
+}
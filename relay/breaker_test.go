@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b, err := newCircuitBreaker(config.CircuitBreakerConfig{}, "relay", "backend")
+	assert.NoError(t, err)
+	assert.Nil(t, b)
+	assert.Equal(t, time.Duration(0), b.openFor())
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b, err := newCircuitBreaker(config.CircuitBreakerConfig{
+		Enabled:        true,
+		FailureRatio:   0.5,
+		MinRequests:    4,
+		Window:         "1m",
+		OpenDuration:   "50ms",
+		HalfOpenProbes: 2,
+	}, "relay", "backend")
+	assert.NoError(t, err)
+
+	// Not enough writes to open the circuit yet
+	for _, success := range []bool{false, false, true} {
+		ok, probe := b.allow()
+		assert.True(t, ok)
+		assert.False(t, probe)
+		b.record(success, probe)
+	}
+	assert.Equal(t, "closed", b.stateName())
+
+	b.record(false, false)
+	assert.Equal(t, "open", b.stateName())
+	assert.True(t, b.openFor() > 0)
+
+	ok, _ := b.allow()
+	assert.False(t, ok)
+
+	// Once the open duration elapsed, only the probes are sent
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.openFor())
+
+	ok, probe := b.allow()
+	assert.True(t, ok)
+	assert.True(t, probe)
+	assert.Equal(t, "half-open", b.stateName())
+
+	ok2, probe2 := b.allow()
+	assert.True(t, ok2)
+	assert.True(t, probe2)
+
+	ok, _ = b.allow()
+	assert.False(t, ok)
+
+	// A failed probe opens the circuit again
+	b.record(false, true)
+	assert.Equal(t, "open", b.stateName())
+
+	// The outcome of a probe sent before is ignored
+	b.record(true, probe2)
+	assert.Equal(t, "open", b.stateName())
+
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		ok, probe = b.allow()
+		assert.True(t, ok)
+		b.record(true, probe)
+	}
+	assert.Equal(t, "closed", b.stateName())
+
+	ok, probe = b.allow()
+	assert.True(t, ok)
+	assert.False(t, probe)
+}
+
+func TestSimplePosterCircuitOpen(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	p := newOutputPoster(config.HTTPOutputConfig{Location: server.URL}, time.Second)
+	b, err := newCircuitBreaker(config.CircuitBreakerConfig{
+		Enabled:      true,
+		FailureRatio: 1,
+		MinRequests:  2,
+		OpenDuration: "1m",
+	}, "relay", "backend")
+	assert.NoError(t, err)
+	p.breaker = b
+
+	for i := 0; i < 2; i++ {
+		resp, err := p.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "/write")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	// The backend is not reached while the circuit is open
+	resp, err := p.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "/write")
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Nil(t, resp)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/tracing"
+)
+
+// coalesceSenders is the number of coalesced batches of a backend sent at
+// once, the next batches waiting in the list while the backend is slow
+const coalesceSenders = 4
+
+// coalescer sends the small writes of a backend together, grouped in the
+// same way as the batches of a retry buffer, a batch being sent once full or
+// once its first write waited for linger
+type coalescer struct {
+	list   *bufferList
+	linger time.Duration
+
+	// relay and backend names, used to tag spans
+	relay   string
+	backend string
+
+	p poster
+}
+
+func newCoalescer(relay, backend string, linger time.Duration, maxBatch int, p poster) *coalescer {
+	c := &coalescer{
+		// The writes are held by their requests until sent,
+		// the list does not have to bound them
+		list:    newBufferList(math.MaxInt32, maxBatch),
+		linger:  linger,
+		relay:   relay,
+		backend: backend,
+		p:       p,
+	}
+	for i := 0; i < coalesceSenders; i++ {
+		go c.run()
+	}
+	return c
+}
+
+// post waits for the write to be sent along with the ones coalesced with it,
+// the response of the backend being the one of all those writes
+func (c *coalescer) post(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	// The prometheus remote writes cannot be concatenated,
+	// and the buffer already batches the writes
+	if isProm(endpoint) || c.buffering() {
+		return c.p.post(ctx, buf, query, auth, endpoint)
+	}
+
+	b, err := c.list.add(ctx, buf, query, auth, endpoint)
+	if err != nil {
+		return c.p.post(ctx, buf, query, auth, endpoint)
+	}
+
+	// buf belongs to the request until the batch is sent
+	b.wg.Wait()
+	return b.resp, b.err
+}
+
+// buffering tells whether the writes go to the retry buffer of the backend
+func (c *coalescer) buffering() bool {
+	r, ok := c.p.(*retryBuffer)
+	return ok && (atomic.LoadInt32(&r.buffering) == 1 || atomic.LoadInt32(&r.paused) == 1)
+}
+
+func (c *coalescer) run() {
+	for {
+		c.send(c.list.popLingered(c.linger))
+	}
+}
+
+// send posts a coalesced batch, in a span of the traces of its writes
+func (c *coalescer) send(b *batch) {
+	defer b.wg.Done()
+
+	buf := getBuf()
+	defer putBuf(buf)
+	_ = b.load(buf)
+
+	ctx, span := b.startSpan(tracing.SpanBatch)
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("relay", c.relay),
+		trace.StringAttribute("backend", c.backend),
+		trace.Int64Attribute("writes", int64(len(b.bufs))),
+		trace.Int64Attribute("bytes", int64(buf.Len())),
+	)
+
+	b.resp, b.err = c.p.post(ctx, buf.Bytes(), b.query, b.auth, b.endpoint)
+	tracing.SetResponse(span, statusCode(b.resp), b.err)
+}
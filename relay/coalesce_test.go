@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescerLinger(t *testing.T) {
+	p := &mockPoster{status: http.StatusNoContent}
+	c := newCoalescer("relay", "backend", 50*time.Millisecond, KB, p)
+
+	var wg sync.WaitGroup
+	for _, w := range []struct {
+		buf   string
+		query string
+	}{
+		{"cpu v=1\n", "db=a"},
+		{"cpu v=2\n", "db=a"},
+		{"cpu v=3\n", "db=b"},
+	} {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.post(context.Background(), []byte(w.buf), w.query, "", "/write")
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	// One request per database, the writes of a database being in order
+	// of arrival, which the goroutines do not guarantee
+	posted := make([]string, len(p.posted))
+	for i, b := range p.posted {
+		posted[i] = string(b)
+	}
+	sort.Strings(posted)
+	assert.Len(t, posted, 2)
+	assert.Contains(t, []string{"cpu v=1\ncpu v=2\n", "cpu v=2\ncpu v=1\n"}, posted[0])
+	assert.Equal(t, "cpu v=3\n", posted[1])
+}
+
+func TestCoalescerFull(t *testing.T) {
+	p := &mockPoster{status: http.StatusNoContent}
+	c := newCoalescer("relay", "backend", time.Hour, 16, p)
+
+	// A batch reaching its maximum size does not wait for the linger
+	resp, err := c.post(context.Background(), make([]byte, 16), "db=a", "", "/write")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// Neither do the prometheus writes
+	_, err = c.post(context.Background(), []byte("snappy"), "db=a", "", "/api/v1/prom/write")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, p.count())
+}
+
+func TestCoalescerError(t *testing.T) {
+	p := &mockPoster{err: errors.New("down")}
+	c := newCoalescer("relay", "backend", time.Millisecond, KB, p)
+
+	resp, err := c.post(context.Background(), []byte("cpu v=1\n"), "db=a", "", "/write")
+	assert.EqualError(t, err, "down")
+	assert.Nil(t, resp)
+}
+
+func TestCoalescerSenders(t *testing.T) {
+	var mu sync.Mutex
+	sending, most := 0, 0
+	release := make(chan struct{})
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		mu.Lock()
+		sending++
+		if sending > most {
+			most = sending
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		sending--
+		mu.Unlock()
+		return &responseData{StatusCode: http.StatusNoContent}, nil
+	})
+	c := newCoalescer("relay", "backend", time.Millisecond, KB, p)
+
+	// The batches of a slow backend wait for a sender
+	var wg sync.WaitGroup
+	for i := 0; i < 3*coalesceSenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = c.post(context.Background(), []byte("cpu v=1\n"), fmt.Sprintf("db=%d", i), "", "/write")
+		}(i)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return sending == coalesceSenders
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, coalesceSenders, most)
+}
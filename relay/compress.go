@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// gzipWriters pools the gzip writers of each compression level,
+// which are expensive to allocate
+var gzipWriters [gzip.BestCompression + 1]sync.Pool
+
+// gzipLevel returns level, or the default level if it is out of range
+func gzipLevel(level int) int {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return config.DefaultCompressionLevel
+	}
+	return level
+}
+
+// gzipTo appends the compression of buf to dst
+func gzipTo(dst *bytes.Buffer, buf []byte, level int) error {
+	level = gzipLevel(level)
+
+	zw, _ := gzipWriters[level].Get().(*gzip.Writer)
+	if zw == nil {
+		var err error
+		if zw, err = gzip.NewWriterLevel(dst, level); err != nil {
+			return err
+		}
+	} else {
+		zw.Reset(dst)
+	}
+	defer gzipWriters[level].Put(zw)
+
+	if _, err := zw.Write(buf); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// gunzipTo appends the decompression of r to dst,
+// r may hold several gzip members one after the other
+func gunzipTo(dst *bytes.Buffer, r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	_, err = dst.ReadFrom(zr)
+	return err
+}
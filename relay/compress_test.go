@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func TestGunzipMembers(t *testing.T) {
+	var compressed bytes.Buffer
+	assert.NoError(t, gzipTo(&compressed, []byte("cpu v=1\n"), 1))
+	assert.NoError(t, gzipTo(&compressed, []byte("cpu v=2\n"), 9))
+
+	var body bytes.Buffer
+	assert.NoError(t, gunzipTo(&body, &compressed))
+	assert.Equal(t, "cpu v=1\ncpu v=2\n", body.String())
+}
+
+func TestOutputPosterGzip(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ = ioutil.ReadAll(zr)
+			received <- "gzip " + string(body)
+		} else {
+			body, _ = ioutil.ReadAll(r.Body)
+			received <- "none " + string(body)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	p := newOutputPoster(config.HTTPOutputConfig{
+		Location:         server.URL,
+		Compression:      config.CompressionGzip,
+		CompressionLevel: 9,
+	}, time.Second)
+
+	body := strings.Repeat("cpu,host=server01 value=1\n", 100)
+	resp, err := p.post(context.Background(), []byte(body), "db=test", "", "/write")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "gzip "+body, <-received)
+
+	// The prometheus remote writes are sent as they are
+	_, err = p.post(context.Background(), []byte("snappy"), "db=test", "", "/api/v1/prom/write")
+	assert.NoError(t, err)
+	assert.Equal(t, "none snappy", <-received)
+}
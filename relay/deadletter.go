@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// deadLetter stores the batches given up by a retry buffer
+type deadLetter interface {
+	store(e *deadLetterEntry) error
+}
+
+// deadLetterEntry is a batch given up by a retry buffer, along with the
+// last error returned by the backend
+type deadLetterEntry struct {
+	ID              uint64    `json:"id"`
+	Time            time.Time `json:"time"`
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retentionPolicy,omitempty"`
+	Precision       string    `json:"precision,omitempty"`
+	Endpoint        string    `json:"endpoint"`
+	Size            int       `json:"size"`
+	Attempts        int64     `json:"attempts"`
+	Error           string    `json:"error"`
+
+	query string
+	auth  string
+	body  []byte
+}
+
+func newDeadLetterEntry(b *batch, body []byte, attempts int64, reason error) *deadLetterEntry {
+	params, _ := url.ParseQuery(b.query)
+
+	return &deadLetterEntry{
+		Time:            time.Now(),
+		Database:        params.Get("db"),
+		RetentionPolicy: params.Get("rp"),
+		Precision:       params.Get("precision"),
+		Endpoint:        b.endpoint,
+		Size:            len(body),
+		Attempts:        attempts,
+		Error:           reason.Error(),
+		query:           b.query,
+		auth:            b.auth,
+		body:            append([]byte(nil), body...),
+	}
+}
+
+// isProm tells whether the endpoint receives prometheus remote writes,
+// which are snappy compressed protobuf rather than line protocol
+func isProm(endpoint string) bool {
+	return strings.HasSuffix(endpoint, "prom/write")
+}
+
+// newDeadLetter creates the memory or file dead letter described by cfg,
+// the output dead letters are set once all the backends exist
+func newDeadLetter(cfg config.DeadLetterConfig, relay, backend string) (deadLetter, error) {
+	switch cfg.Type {
+	case config.DeadLetterMemory:
+		size := cfg.MaxSizeMB
+		if size == 0 {
+			size = config.DefaultDeadLetterSizeMB
+		}
+		return &memoryDeadLetter{maxSize: size * MB}, nil
+
+	case config.DeadLetterFile:
+		if err := os.MkdirAll(cfg.Path, 0755); err != nil {
+			return nil, err
+		}
+		return &fileDeadLetter{dir: cfg.Path, prefix: fileName(relay) + "_" + fileName(backend)}, nil
+	}
+
+	return nil, nil
+}
+
+// memoryDeadLetter keeps the last batches given up, up to maxSize bytes
+type memoryDeadLetter struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	lastID  uint64
+	entries []*deadLetterEntry
+}
+
+func (m *memoryDeadLetter) store(e *deadLetterEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	e.ID = m.lastID
+	m.entries = append(m.entries, e)
+	m.size += e.Size
+
+	for m.size > m.maxSize && len(m.entries) > 0 {
+		m.size -= m.entries[0].Size
+		m.entries = m.entries[1:]
+	}
+
+	return nil
+}
+
+// list returns the stored entries, the oldest first
+func (m *memoryDeadLetter) list() []*deadLetterEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*deadLetterEntry{}, m.entries...)
+}
+
+func (m *memoryDeadLetter) get(id uint64) *deadLetterEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// remove deletes an entry, telling whether it was found
+func (m *memoryDeadLetter) remove(id uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.entries {
+		if e.ID == id {
+			m.size -= e.Size
+			m.entries = append(m.entries[:i:i], m.entries[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fileName turns a relay or backend name, which may be a URL, into a file name
+func fileName(name string) string {
+	return strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_")
+}
+
+// fileDeadLetter writes each batch given up into its own file, as
+// line protocol in the format of influx_inspect export
+type fileDeadLetter struct {
+	dir    string
+	prefix string
+
+	mu     sync.Mutex
+	lastID uint64
+}
+
+func (f *fileDeadLetter) store(e *deadLetterEntry) error {
+	f.mu.Lock()
+	f.lastID++
+	e.ID = f.lastID
+	f.mu.Unlock()
+
+	var buf bytes.Buffer
+	ext := ".lp"
+	if isProm(e.Endpoint) {
+		ext = ".pb"
+	} else {
+		fmt.Fprintf(&buf, "# error: %s\n", strings.Replace(e.Error, "\n", " ", -1))
+		writeContext(&buf, e.Precision, e.Database, e.RetentionPolicy)
+	}
+	buf.Write(e.body)
+
+	name := fmt.Sprintf("%s_%s_%d%s", f.prefix, e.Time.UTC().Format("20060102T150405.000000000Z"), e.ID, ext)
+	return ioutil.WriteFile(filepath.Join(f.dir, name), buf.Bytes(), 0644)
+}
+
+// writeContext writes the header telling replay where the lines
+// of a file go, in the format of influx -import
+func writeContext(buf *bytes.Buffer, precision string, db string, rp string) {
+	if precision != "" {
+		fmt.Fprintf(buf, "# precision: %s\n", precision)
+	}
+	fmt.Fprintf(buf, "# DML\n# CONTEXT-DATABASE: %s\n# CONTEXT-RETENTION-POLICY: %s\n", db, rp)
+}
+
+// outputDeadLetter sends the batches given up to another backend,
+// without buffering them if it fails as well
+type outputDeadLetter struct {
+	b *httpBackend
+}
+
+func (o *outputDeadLetter) store(e *deadLetterEntry) error {
+	endpoint := o.b.endpoints.Write
+	if isProm(e.Endpoint) {
+		endpoint = o.b.endpoints.PromWrite
+	}
+
+	p := o.b.getSimplePoster()
+	resp, err := p.post(context.Background(), e.body, e.query, e.auth, endpoint)
+	if err = responseError(resp, err); err != nil {
+		return fmt.Errorf("output %q: %v", o.b.name, err)
+	}
+
+	return nil
+}
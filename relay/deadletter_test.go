@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func deadLetterBatch(body string) *deadLetterEntry {
+	b := newBatch([]byte(body), "db=test&precision=s", "", "/write")
+	return newDeadLetterEntry(b, []byte(body), 5, errors.New("500 response: engine panic"))
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	d := &memoryDeadLetter{maxSize: 20}
+
+	for _, body := range []string{"cpu v=1 1\n", "cpu v=2 2\n", "cpu v=3 3\n"} {
+		assert.NoError(t, d.store(deadLetterBatch(body)))
+	}
+
+	// The oldest batch is dropped to make room
+	entries := d.list()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, uint64(2), entries[0].ID)
+		assert.Equal(t, "s", entries[0].Precision)
+	}
+
+	assert.True(t, d.remove(2))
+	assert.False(t, d.remove(2))
+	assert.Nil(t, d.get(2))
+	assert.Equal(t, "cpu v=3 3\n", string(d.get(3).body))
+}
+
+func TestFileDeadLetter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "deadletter")
+	defer os.RemoveAll(dir)
+
+	d, err := newDeadLetter(config.DeadLetterConfig{Type: config.DeadLetterFile, Path: dir}, "relay", "http://influxdb:8086/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, d.store(deadLetterBatch("cpu v=1 1\n")))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "relay_http_influxdb_8086_*_1.lp"))
+	if assert.Len(t, files, 1) {
+		data, _ := ioutil.ReadFile(files[0])
+		assert.Equal(t, "# error: 500 response: engine panic\n# precision: s\n"+
+			"# DML\n# CONTEXT-DATABASE: test\n# CONTEXT-RETENTION-POLICY: \ncpu v=1 1\n", string(data))
+	}
+}
+
+func TestOutputDeadLetter(t *testing.T) {
+	received := make(chan string, 1)
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.URL.Path + "?" + r.URL.RawQuery + " " + string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer archive.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name: "dead-letter",
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "main", Location: Error500.URL, BufferSizeMB: 1, DeadLetter: config.DeadLetterConfig{Type: config.DeadLetterOutput, Output: "archive"}},
+			{Name: "archive", Location: archive.URL, Endpoints: config.HTTPEndpointConfig{Write: "/write"}},
+		},
+	}, false)
+
+	d, ok := h.backends[0].getRetryBuffer().deadLetter.(*outputDeadLetter)
+	if assert.True(t, ok) {
+		assert.NoError(t, d.store(deadLetterBatch("cpu v=1 1\n")))
+		assert.Equal(t, "/write?db=test&precision=s cpu v=1 1\n", <-received)
+	}
+}
@@ -2,18 +2,17 @@ package relay
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,6 +21,7 @@ import (
 
 	"github.com/influxdata/influxdb/models"
 	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
 	"github.com/strike-team/influxdb-relay/metric"
 )
 
@@ -40,15 +40,36 @@ type HTTP struct {
 	closing int64
 	l       net.Listener
 
+	counters relayCounters
+
 	backends []*httpBackend
 
-	start  time.Time
-	log    bool
-	logger *log.Logger
+	start     time.Time
+	logger    *logging.Logger
+	accessLog *accessLog
 
 	rateLimiter *rate.Limiter
 
+	// passthrough forwards the writes without parsing them, validating
+	// their lines if validateLines is set
+	passthrough   bool
+	validateLines bool
+
+	// maxBodySize bounds the request bodies, the writes above
+	// streamThreshold being forwarded by chunks of streamChunk points
+	maxBodySize     int64
+	streamThreshold int64
+	streamChunk     int
+
+	// ackSync is set while the writes are acknowledged once sent
+	// because a queue of the backends is above its high watermark
+	ackSync int32
+
 	healthTimeout time.Duration
+
+	// metrics are served on metricsPath when it is set
+	metricsPath    string
+	metricsHandler http.Handler
 }
 
 type relayHandlerFunc func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time)
@@ -56,10 +77,10 @@ type relayMiddleware func(h *HTTP, handlerFunc relayHandlerFunc) relayHandlerFun
 
 // Default HTTP settings and a few constants
 const (
-	DefaultHTTPPingResponse = http.StatusNoContent
-	DefaultHTTPTimeout      = 10 * time.Second
-	DefaultMaxDelayInterval = 10 * time.Second
-	DefaultBatchSizeKB      = 512
+	DefaultHTTPPingResponse = config.DefaultHTTPPingResponse
+	DefaultHTTPTimeout      = config.DefaultHTTPTimeout
+	DefaultMaxDelayInterval = config.DefaultMaxDelayInterval
+	DefaultBatchSizeKB      = config.DefaultMaxBatchKB
 
 	KB = 1024
 	MB = 1024 * KB
@@ -67,13 +88,22 @@ const (
 
 var (
 	handlers = map[string]relayHandlerFunc{
-		"/write":             (*HTTP).handleStandard,
-		"/api/v1/prom/write": (*HTTP).handleProm,
-		"/ping":              (*HTTP).handlePing,
-		"/status":            (*HTTP).handleStatus,
-		"/admin":             (*HTTP).handleAdmin,
-		"/admin/flush":       (*HTTP).handleFlush,
-		"/health":            (*HTTP).handleHealth,
+		"/write":                   (*HTTP).handleStandard,
+		"/api/v1/prom/write":       (*HTTP).handleProm,
+		"/ping":                    (*HTTP).handlePing,
+		"/status":                  (*HTTP).handleStatus,
+		"/admin":                   (*HTTP).handleAdmin,
+		"/admin/flush":             (*HTTP).handleFlush,
+		"/admin/backend":           (*HTTP).handleBackendAdmin,
+		"/admin/backend/pause":     (*HTTP).handleBackendAdmin,
+		"/admin/backend/resume":    (*HTTP).handleBackendAdmin,
+		"/admin/backend/retry":     (*HTTP).handleBackendAdmin,
+		"/admin/buffer":            (*HTTP).handleBuffer,
+		"/admin/buffer/batch":      (*HTTP).handleBufferBatch,
+		"/admin/buffer/export":     (*HTTP).handleBufferExport,
+		"/admin/dead-letter":       (*HTTP).handleDeadLetter,
+		"/admin/dead-letter/batch": (*HTTP).handleDeadLetterBatch,
+		"/health":                  (*HTTP).handleHealth,
 	}
 
 	middlewares = []relayMiddleware{
@@ -81,6 +111,7 @@ var (
 		(*HTTP).queryMiddleWare,
 		(*HTTP).logMiddleWare,
 		(*HTTP).rateMiddleware,
+		(*HTTP).accessLogMiddleware,
 	}
 )
 
@@ -92,8 +123,6 @@ func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters) (Relay, err
 
 	h.addr = cfg.Addr
 	h.name = cfg.Name
-	h.log = verbose
-	h.logger = log.New(os.Stdout, "relay: ", 0)
 
 	h.pingResponseCode = DefaultHTTPPingResponse
 	if cfg.DefaultPingResponse != 0 {
@@ -116,16 +145,79 @@ func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters) (Relay, err
 		h.schema = "https"
 	}
 
+	logger, err := relayLogger(cfg.LogLevel, verbose)
+	if err != nil {
+		return nil, fmt.Errorf("relay %q: %v", h.Name(), err)
+	}
+	h.logger = logger.With("relay", h.Name())
+
+	if h.accessLog, err = newAccessLog(cfg.AccessLog); err != nil {
+		return nil, fmt.Errorf("relay %q: %v", h.Name(), err)
+	}
+
 	// For each output specified in the config, we are going to create a backend
 	for i := range cfg.Outputs {
-		backend, err := newHTTPBackend(&cfg.Outputs[i], fs)
+		backend, err := newHTTPBackend(&cfg.Outputs[i], h.Name(), fs)
 		if err != nil {
 			return nil, err
 		}
 
+		if r := backend.getRetryBuffer(); r != nil {
+			r.logger = h.logger.With("backend", backend.name)
+		}
+
+		if cfg.AsyncAck.Enabled {
+			backend.queue = newAckQueue(cfg.AsyncAck, backend)
+			backend.queue.logger = h.logger.With("backend", backend.name)
+
+			senders := config.DefaultAckSenders
+			if cfg.AsyncAck.Senders > 0 {
+				senders = cfg.AsyncAck.Senders
+			}
+			backend.queue.start(senders)
+		}
+
 		h.backends = append(h.backends, backend)
 	}
 
+	// The dead letter outputs may be defined after the outputs using them
+	for i, o := range cfg.Outputs {
+		if o.DeadLetter.Type != config.DeadLetterOutput {
+			continue
+		}
+
+		target := h.backend(o.DeadLetter.Output)
+		if target == nil || target == h.backends[i] {
+			return nil, fmt.Errorf("relay %q: output %q: unknown dead letter output %q", h.Name(), o.Name, o.DeadLetter.Output)
+		}
+
+		if r := h.backends[i].getRetryBuffer(); r != nil {
+			r.deadLetter = &outputDeadLetter{b: target}
+		}
+	}
+
+	if cfg.Passthrough {
+		h.passthrough = true
+		h.validateLines = cfg.PassthroughValidate
+
+		for _, b := range h.backends {
+			if len(b.tagRegexps) > 0 || len(b.measurementRegexps) > 0 {
+				h.logger.Warn("output with filters, writes parsed despite passthrough", "backend", b.name)
+				h.passthrough = false
+				break
+			}
+		}
+	}
+
+	h.maxBodySize = int64(cfg.MaxBodySizeMB) * MB
+	if cfg.StreamThresholdMB > 0 {
+		h.streamThreshold = int64(cfg.StreamThresholdMB) * MB
+		h.streamChunk = config.DefaultStreamChunkPoints
+		if cfg.StreamChunkPoints > 0 {
+			h.streamChunk = cfg.StreamChunkPoints
+		}
+	}
+
 	// If a RateLimit is specified, create a new limiter
 	if cfg.RateLimit != 0 {
 		if cfg.BurstLimit != 0 {
@@ -137,9 +229,43 @@ func NewHTTP(cfg config.HTTPConfig, verbose bool, fs config.Filters) (Relay, err
 
 	h.healthTimeout = time.Duration(cfg.HealthTimeout) * time.Millisecond
 
+	if cfg.MetricsPath != "" {
+		if _, ok := handlers[cfg.MetricsPath]; ok {
+			return nil, fmt.Errorf("relay %q: metrics path %q is already used by the relay", h.Name(), cfg.MetricsPath)
+		}
+
+		handler, err := metric.Handler()
+		if err != nil {
+			return nil, err
+		}
+
+		h.metricsPath = cfg.MetricsPath
+		h.metricsHandler = handler
+	}
+
 	return h, nil
 }
 
+// relayLogger returns the default logger, with the level of the relay if set,
+// verbose relays log at the debug level otherwise
+func relayLogger(level string, verbose bool) (*logging.Logger, error) {
+	logger := logging.Default()
+
+	if level != "" {
+		l, err := logging.ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		return logger.WithLevel(l), nil
+	}
+
+	if verbose {
+		return logger.WithLevel(logging.LevelDebug), nil
+	}
+
+	return logger, nil
+}
+
 // Name is the name of the HTTP relay
 // a default name might be generated if it is
 // not specified in the configuration file
@@ -173,9 +299,7 @@ func (h *HTTP) Run() error {
 
 	h.l = l
 
-	if h.log {
-		h.logger.Printf("starting %s relay %q on %v", strings.ToUpper(h.schema), h.Name(), h.addr)
-	}
+	h.logger.Info("starting relay", "type", h.schema, "addr", h.addr)
 
 	err = http.Serve(l, metric.HTTPHandler(h))
 	if atomic.LoadInt64(&h.closing) != 0 {
@@ -194,6 +318,12 @@ func (h *HTTP) Stop() error {
 // The response is a JSON object describing the state of the operation
 func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// h.start = time.Now()
+	atomic.AddInt64(&h.counters.requests, 1)
+
+	if h.metricsPath != "" && r.URL.Path == h.metricsPath {
+		h.metricsHandler.ServeHTTP(w, r)
+		return
+	}
 
 	if fun, ok := handlers[r.URL.Path]; ok {
 		allMiddlewares(h, fun)(h, w, r, time.Now())
@@ -203,6 +333,15 @@ func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statusCode returns the status code of a response, 0 if there is none
+func statusCode(rd *responseData) int {
+	if rd == nil {
+		return 0
+	}
+
+	return rd.StatusCode
+}
+
 type responseData struct {
 	ContentType     string
 	ContentEncoding string
@@ -238,21 +377,22 @@ func jsonResponse(w http.ResponseWriter, r response) {
 	_, _ = w.Write(data)
 }
 
-type stats interface {
-}
-
 type poster interface {
-	post([]byte, string, string, string) (*responseData, error)
-	getStats() stats
-}
-
-type simpleStats struct {
-	Location string `json:"location"`
+	post(context.Context, []byte, string, string, string) (*responseData, error)
 }
 
 type simplePoster struct {
 	client   *http.Client
 	location string
+
+	// compression of the writes, at the given gzip level
+	compression string
+	level       int
+
+	// breaker fails the writes at once while the backend is failing, if set
+	breaker *circuitBreaker
+
+	counters backendCounters
 }
 
 func newSimplePoster(location string, timeout time.Duration, skipTLSVerification bool) *simplePoster {
@@ -273,19 +413,78 @@ func newSimplePoster(location string, timeout time.Duration, skipTLSVerification
 	}
 }
 
-func (s *simplePoster) getStats() stats {
-	return simpleStats{Location: s.location}
+// newOutputPoster returns the poster of an output, which compresses
+// the writes as told by its configuration
+func newOutputPoster(cfg config.HTTPOutputConfig, timeout time.Duration) *simplePoster {
+	s := newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+	s.compression = cfg.Compression
+	s.level = cfg.CompressionLevel
+	return s
 }
 
-func (s *simplePoster) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
-	req, err := http.NewRequest("POST", s.location+endpoint, bytes.NewReader(buf))
+func (s *simplePoster) post(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	var probe bool
+	if s.breaker != nil {
+		var ok bool
+		if ok, probe = s.breaker.allow(); !ok {
+			metric.RecordCircuitRejected(s.breaker.relay, s.breaker.backend, len(buf))
+			return nil, ErrCircuitOpen
+		}
+	}
+
+	start := time.Now()
+	resp, err := s.do(ctx, buf, query, auth, endpoint)
+	s.counters.record(len(buf), time.Since(start), responseError(resp, err))
+
+	// A 4xx tells the backend is up, only the data is wrong
+	if s.breaker != nil {
+		s.breaker.record(err == nil && resp.StatusCode/100 != 5, probe)
+	}
+
+	return resp, err
+}
+
+// responseError returns err, or an error describing
+// the response if the backend did not accept the write
+func responseError(resp *responseData, err error) error {
+	if err != nil || resp.StatusCode/100 == 2 {
+		return err
+	}
+
+	body := bytes.TrimSpace(resp.Body)
+	if len(body) > 256 {
+		body = body[:256]
+	}
+
+	return fmt.Errorf("%d response: %s", resp.StatusCode, body)
+}
+
+func (s *simplePoster) do(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	body := buf
+
+	// The prometheus remote writes are already snappy compressed
+	gzipped := s.compression == config.CompressionGzip && !isProm(endpoint)
+	if gzipped {
+		zbuf := getBuf()
+		defer putBuf(zbuf)
+
+		if err := gzipTo(zbuf, buf, s.level); err != nil {
+			return nil, err
+		}
+		body = zbuf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.location+endpoint, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
 	req.URL.RawQuery = query
 	req.Header.Set("Content-Type", "text/plain")
-	req.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	if auth != "" {
 		req.Header.Set("Authorization", auth)
 	}
@@ -312,11 +511,18 @@ func (s *simplePoster) post(buf []byte, query string, auth string, endpoint stri
 type httpBackend struct {
 	poster
 	name      string
+	relay     string
 	inputType config.Input
 	admin     string
 	endpoints config.HTTPEndpointConfig
 	location  string
 
+	// precision of the timestamps sent to the backend, if normalized
+	precision string
+
+	// queue holds the writes acknowledged before being sent, if enabled
+	queue *ackQueue
+
 	tagRegexps         []*regexp.Regexp
 	measurementRegexps []*regexp.Regexp
 }
@@ -326,39 +532,110 @@ type httpBackend struct {
 func (b *httpBackend) validateRegexps(ps models.Points) error {
 	// For each point
 	for _, p := range ps {
-		// Check if the measurement of each point
-		// matches ALL measurement regular expressions
-		m := p.Name()
-		for _, r := range b.measurementRegexps {
-			if !r.Match(m) {
-				return errors.New("bad measurement")
+		if err := matchRegexps(p, b.tagRegexps, b.measurementRegexps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchRegexps checks if a single point matches all the tag
+// and measurement regular expressions
+func matchRegexps(p models.Point, tagRegexps, measurementRegexps []*regexp.Regexp) error {
+	// Check if the measurement of the point
+	// matches ALL measurement regular expressions
+	m := p.Name()
+	for _, r := range measurementRegexps {
+		if !r.Match(m) {
+			return errors.New("bad measurement")
+		}
+	}
+
+	// For each tag of the point
+	for _, t := range p.Tags() {
+		// Check if each tag of the point
+		// matches ALL tags regular expressions
+		for _, r := range tagRegexps {
+			if !r.Match(t.Key) {
+				return errors.New("bad tag")
 			}
 		}
+	}
+
+	return nil
+}
 
-		// For each tag of each point
-		for _, t := range p.Tags() {
-			// Check if each tag of each point
-			// matches ALL tags regular expressions
-			for _, r := range b.tagRegexps {
-				if !r.Match(t.Key) {
-					return errors.New("bad tag")
+// filterRegexps returns the regular expressions of the filters
+// applied on the given output
+func filterRegexps(name string, fs config.Filters) ([]*regexp.Regexp, []*regexp.Regexp) {
+	var tagRegexps []*regexp.Regexp
+	var measurementRegexps []*regexp.Regexp
+
+	for _, f := range fs {
+		for _, e := range f.Outputs {
+			if e == name {
+				if f.TagRegexp != nil {
+					tagRegexps = append(tagRegexps, f.TagRegexp)
+				}
+
+				if f.MeasurementRegexp != nil {
+					measurementRegexps = append(measurementRegexps, f.MeasurementRegexp)
 				}
 			}
 		}
 	}
 
+	return tagRegexps, measurementRegexps
+}
+
+// writeEndpoint returns the write endpoint of an output,
+// defaulting to the standard InfluxDB one
+func writeEndpoint(cfg config.HTTPOutputConfig) string {
+	if cfg.Endpoints.Write != "" {
+		return cfg.Endpoints.Write
+	}
+
+	if cfg.Location != "" && cfg.Location[len(cfg.Location)-1] != '/' {
+		return "/write"
+	}
+
+	return "write"
+}
+
+// unwrap returns the poster of the backend, the writes being coalesced or not
+func (b *httpBackend) unwrap() poster {
+	if c, ok := b.poster.(*coalescer); ok {
+		return c.p
+	}
+
+	return b.poster
+}
+
+// getSimplePoster returns the poster actually sending
+// the requests, whether the backend is buffered or not
+func (b *httpBackend) getSimplePoster() *simplePoster {
+	switch p := b.unwrap().(type) {
+	case *simplePoster:
+		return p
+	case *retryBuffer:
+		if s, ok := p.p.(*simplePoster); ok {
+			return s
+		}
+	}
+
 	return nil
 }
 
 func (b *httpBackend) getRetryBuffer() *retryBuffer {
-	if p, ok := b.poster.(*retryBuffer); ok {
+	if p, ok := b.unwrap().(*retryBuffer); ok {
 		return p
 	}
 
 	return nil
 }
 
-func newHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters) (*httpBackend, error) {
+func newHTTPBackend(cfg *config.HTTPOutputConfig, relay string, fs config.Filters) (*httpBackend, error) {
 	// Get default name
 	if cfg.Name == "" {
 		cfg.Name = cfg.Location
@@ -375,10 +652,18 @@ func newHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters) (*httpBacke
 	}
 
 	// Get underlying Poster instance
-	var p poster = newSimplePoster(cfg.Location, timeout, cfg.SkipTLSVerification)
+	sp := newOutputPoster(*cfg, timeout)
+
+	breaker, err := newCircuitBreaker(cfg.CircuitBreaker, relay, cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	sp.breaker = breaker
+
+	var p poster = sp
 
 	// If configured, create a retryBuffer per backend.
-	// This way we serialize retries against each backend.
+	// This way we bound the concurrent retries against each backend.
 	if cfg.BufferSizeMB > 0 {
 		max := DefaultMaxDelayInterval
 		if cfg.MaxDelayInterval != "" {
@@ -394,40 +679,119 @@ func newHTTPBackend(cfg *config.HTTPOutputConfig, fs config.Filters) (*httpBacke
 			batch = cfg.MaxBatchKB * KB
 		}
 
-		p = newRetryBuffer(cfg.BufferSizeMB*MB, batch, max, p)
-	}
+		r := newRetryBuffer(relay, cfg.Name, cfg.BufferSizeMB*MB, batch, max, p)
+		r.maxAttempts = int64(cfg.MaxAttempts)
+		r.split = cfg.SplitBatches
+		r.drain = cfg.DrainBeforePassthrough
 
-	var tagRegexps []*regexp.Regexp
-	var measurementRegexps []*regexp.Regexp
+		if cfg.RetryInitialInterval != "" {
+			i, err := time.ParseDuration(cfg.RetryInitialInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing retry initial interval %v", err)
+			}
+			r.initialInterval = i
+		}
 
-	// Get regexps related to this HTTP backend
-	for _, f := range fs {
-		for _, e := range f.Outputs {
-			if e == cfg.Name {
-				if f.TagRegexp != nil {
-					tagRegexps = append(tagRegexps, f.TagRegexp)
-				}
+		if cfg.RetryMultiplier >= 1 {
+			r.multiplier = cfg.RetryMultiplier
+		}
 
-				if f.MeasurementRegexp != nil {
-					measurementRegexps = append(measurementRegexps, f.MeasurementRegexp)
-				}
+		r.overflow = cfg.OverflowPolicy
+		r.overflowTimeout = config.DefaultOverflowTimeout
+		if cfg.OverflowTimeout != "" {
+			t, err := time.ParseDuration(cfg.OverflowTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing overflow timeout %v", err)
 			}
+			r.overflowTimeout = t
 		}
+
+		if cfg.OverflowPolicy == config.OverflowSpill {
+			if err := os.MkdirAll(cfg.SpillPath, 0755); err != nil {
+				return nil, fmt.Errorf("output %q: %v", cfg.Name, err)
+			}
+
+			size := cfg.SpillSizeMB
+			if size == 0 {
+				size = config.DefaultSpillSizeMB
+			}
+
+			r.list.spillDir = cfg.SpillPath
+			r.list.spillPrefix = fileName(relay) + "_" + fileName(cfg.Name)
+			r.list.maxSpill = size * MB
+		}
+
+		r.list.compress = cfg.BufferCompression
+		r.list.level = cfg.CompressionLevel
+		r.breaker = breaker
+
+		if cfg.DrainRateKB > 0 {
+			// A batch must fit in the burst of the limiter
+			burst := cfg.DrainRateKB * KB
+			if burst < batch {
+				burst = batch
+			}
+			r.limiter = rate.NewLimiter(rate.Limit(cfg.DrainRateKB*KB), burst)
+		}
+
+		if cfg.MaxAge != "" {
+			m, err := time.ParseDuration(cfg.MaxAge)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing max age %v", err)
+			}
+			r.maxAge = m
+		}
+
+		d, err := newDeadLetter(cfg.DeadLetter, relay, cfg.Name)
+		if err != nil {
+			return nil, fmt.Errorf("output %q: %v", cfg.Name, err)
+		}
+		r.deadLetter = d
+
+		// The buffer already runs one worker
+		r.start(cfg.RetryWorkers - 1)
+
+		p = r
+	}
+
+	if cfg.CoalesceLinger != "" {
+		linger, err := time.ParseDuration(cfg.CoalesceLinger)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing coalesce linger %v", err)
+		}
+
+		batch := DefaultBatchSizeKB * KB
+		if cfg.CoalesceMaxKB > 0 {
+			batch = cfg.CoalesceMaxKB * KB
+		}
+
+		p = newCoalescer(relay, cfg.Name, linger, batch, p)
 	}
 
+	// Get regexps related to this HTTP backend
+	tagRegexps, measurementRegexps := filterRegexps(cfg.Name, fs)
+
 	return &httpBackend{
 		poster:             p,
 		name:               cfg.Name,
+		relay:              relay,
 		tagRegexps:         tagRegexps,
 		measurementRegexps: measurementRegexps,
 		endpoints:          cfg.Endpoints,
 		location:           cfg.Location,
+		precision:          cfg.Precision,
 	}, nil
 }
 
 // ErrBufferFull error indicates that retry buffer is full
 var ErrBufferFull = errors.New("retry buffer full")
 
+// ErrBufferDropped error indicates that a buffered write was dropped before being sent
+var ErrBufferDropped = errors.New("buffered write dropped")
+
+// ErrBodyTooLarge error indicates that a request body is above the maximum size of the relay
+var ErrBodyTooLarge = errors.New("request body too large")
+
 var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
 
 func getBuf() *bytes.Buffer {
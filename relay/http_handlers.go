@@ -2,32 +2,157 @@ package relay
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdata/influxdb/models"
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/logging"
+	"github.com/strike-team/influxdb-relay/metric"
+	"github.com/strike-team/influxdb-relay/tracing"
 )
 
 type status struct {
-	Status  map[string]stats `json:"status"`
+	Status map[string]backendStatus `json:"status"`
+	Relay  relayStatus              `json:"relay"`
 }
 
-func (h *HTTP) handleStatus(w http.ResponseWriter, r *http.Request, _ time.Time) {
-	if r.Method == http.MethodGet || r.Method == http.MethodHead {
-		st := status{Status: make(map[string]stats)}
+// relayStatus holds the totals of a relay, the backend
+// counters being summed over all of its backends
+type relayStatus struct {
+	Requests    int64 `json:"requests"`
+	Writes      int64 `json:"writes"`
+	Points      int64 `json:"points"`
+	ParseErrors int64 `json:"parseErrors"`
+	WriteOk     int64 `json:"writeOk"`
+	WriteFail   int64 `json:"writeFail"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// Health states of a backend, as seen by the writes sent to it
+const (
+	healthUnknown   = "unknown"
+	healthUp        = "up"
+	healthDown      = "down"
+	healthBuffering = "buffering"
+	healthPaused    = "paused"
+)
 
-		for _, b := range h.backends {
-			st.Status[b.name] = b.poster.getStats()
+type backendStatus struct {
+	Location     string     `json:"location"`
+	Health       string     `json:"health"`
+	WriteOk      int64      `json:"writeOk"`
+	WriteFail    int64      `json:"writeFail"`
+	Bytes        int64      `json:"bytes"`
+	AvgLatencyMs float64    `json:"avgLatencyMs"`
+	LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	LastError    *time.Time `json:"lastError,omitempty"`
+	LastErrorMsg string     `json:"lastErrorMessage,omitempty"`
+
+	// Circuit is the state of the circuit breaker, if enabled
+	Circuit string `json:"circuit,omitempty"`
+
+	// Queued is the size of the acknowledged writes not sent yet, with async-ack
+	Queued int `json:"queued,omitempty"`
+
+	// buffered backends only
+	*retryStats
+}
+
+// status returns the statistics of the writes sent to the backend
+func (b *httpBackend) status() backendStatus {
+	st := backendStatus{Location: b.location, Health: healthUnknown}
+
+	if s := b.getSimplePoster(); s != nil {
+		c := &s.counters
+		st.WriteOk = atomic.LoadInt64(&c.writeOk)
+		st.WriteFail = atomic.LoadInt64(&c.writeFail)
+		st.Bytes = atomic.LoadInt64(&c.writeBytes)
+		if n := st.WriteOk + st.WriteFail; n > 0 {
+			st.AvgLatencyMs = float64(atomic.LoadInt64(&c.latency)) / float64(n) / float64(time.Millisecond)
 		}
 
-		jsonResponse(w, response{http.StatusOK, st})
-	} else {
+		lastSuccess, lastError, msg := c.last()
+		if !lastSuccess.IsZero() {
+			st.LastSuccess = &lastSuccess
+			st.Health = healthUp
+		}
+		if !lastError.IsZero() {
+			st.LastError, st.LastErrorMsg = &lastError, msg
+			if lastError.After(lastSuccess) {
+				st.Health = healthDown
+			}
+		}
+
+		if s.breaker != nil {
+			st.Circuit = s.breaker.stateName()
+			if st.Circuit != circuitStates[circuitClosed] {
+				st.Health = healthDown
+			}
+		}
+	}
+
+	if b.queue != nil {
+		st.Queued = b.queue.size()
+	}
+
+	if r := b.getRetryBuffer(); r != nil {
+		st.retryStats = r.getStats()
+		switch {
+		case st.Paused != 0:
+			st.Health = healthPaused
+		case st.Buffering != 0:
+			st.Health = healthBuffering
+		}
+	}
+
+	return st
+}
+
+func (h *HTTP) handleStatus(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
 		return
 	}
+
+	st := status{
+		Status: make(map[string]backendStatus),
+		Relay: relayStatus{
+			Requests:    atomic.LoadInt64(&h.counters.requests),
+			Writes:      atomic.LoadInt64(&h.counters.writes),
+			Points:      atomic.LoadInt64(&h.counters.points),
+			ParseErrors: atomic.LoadInt64(&h.counters.parseErrors),
+		},
+	}
+
+	only := r.URL.Query().Get("backend")
+	for _, b := range h.backends {
+		bs := b.status()
+		st.Relay.WriteOk += bs.WriteOk
+		st.Relay.WriteFail += bs.WriteFail
+		st.Relay.Bytes += bs.Bytes
+
+		if only == "" || only == b.name {
+			st.Status[b.name] = bs
+		}
+	}
+
+	if only != "" && len(st.Status) == 0 {
+		jsonResponse(w, response{http.StatusNotFound, fmt.Sprintf("unknown backend %q", only)})
+		return
+	}
+
+	jsonResponse(w, response{http.StatusOK, st})
 }
 
 func (h *HTTP) handlePing(w http.ResponseWriter, r *http.Request, _ time.Time) {
@@ -77,15 +202,13 @@ func (h *HTTP) handleHealth(w http.ResponseWriter, _ *http.Request, _ time.Time)
 			res, err := client.Get(b.location + b.endpoints.Ping)
 
 			if err != nil {
-				if h.log {
-					h.logger.Println(err)
-				}
+				h.logger.Debug("health check failed", "backend", b.name, "error", err)
 				healthCheck.err = err
 				responses <- healthCheck
 				return
 			}
 			if res.StatusCode/100 != 2 {
-				healthCheck.err = errors.New("Unexpected error code " + string(res.StatusCode))
+				healthCheck.err = fmt.Errorf("Unexpected error code %d", res.StatusCode)
 			}
 			healthCheck.duration = time.Since(start)
 			responses <- healthCheck
@@ -129,14 +252,14 @@ func (h *HTTP) handleHealth(w http.ResponseWriter, _ *http.Request, _ time.Time)
 }
 
 func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	logger := h.requestLogger(r)
+
 	// Client to perform the raw queries
 	client := http.Client{}
 
 	// Base body for all requests
 	baseBody := bytes.Buffer{}
-	_, err := baseBody.ReadFrom(r.Body)
-	if err != nil {
-		log.Printf("relay %q: could not read body: %v", h.Name(), err)
+	if _, ok := h.readBody(w, r, &baseBody, 0); !ok {
 		return
 	}
 
@@ -168,7 +291,7 @@ func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time)
 			// Forward body
 			req, err := http.NewRequest("POST", b.location+b.endpoints.Query, &bodyBytes)
 			if err != nil {
-				log.Printf("problem posting to relay %q backend %q: could not prepare request: %v", h.Name(), b.name, err)
+				logger.Error("could not prepare query", "backend", b.name, "error", err)
 				responses <- &http.Response{}
 				return
 			}
@@ -180,14 +303,14 @@ func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time)
 			resp, err := client.Do(req)
 			if err != nil {
 				// Internal error
-				log.Printf("problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
+				logger.Error("problem posting query", "backend", b.name, "error", err)
 
 				// So empty response
 				responses <- &http.Response{}
 			} else {
 				if resp.StatusCode/100 == 5 {
 					// HTTP error
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
+					logger.Error("5xx response to query", "backend", b.name, "status", resp.StatusCode)
 				}
 
 				// Get response
@@ -229,20 +352,23 @@ func (h *HTTP) handleAdmin(w http.ResponseWriter, r *http.Request, _ time.Time)
 }
 
 func (h *HTTP) handleFlush(w http.ResponseWriter, r *http.Request, start time.Time) {
-	if h.log {
-		h.logger.Println("Flushing buffers...")
+	h.logger.Debug("flushing buffers")
+
+	backends := h.backends
+	if name := r.URL.Query().Get("backend"); name != "" {
+		b := h.backend(name)
+		if b == nil {
+			jsonResponse(w, response{http.StatusNotFound, fmt.Sprintf("unknown backend %q", name)})
+			return
+		}
+		backends = []*httpBackend{b}
 	}
 
-	for _, b := range h.backends {
+	for _, b := range backends {
 		r := b.getRetryBuffer()
 
 		if r != nil {
-			if h.log {
-				h.logger.Println("Flushing " + b.name)
-			} else {
-				h.logger.Println("NOT flushing " + b.name + " (is empty)")
-			}
-
+			h.logger.Info("flushing buffer", "backend", b.name)
 			r.empty()
 		}
 	}
@@ -250,6 +376,262 @@ func (h *HTTP) handleFlush(w http.ResponseWriter, r *http.Request, start time.Ti
 	jsonResponse(w, response{http.StatusOK, http.StatusText(http.StatusOK)})
 }
 
+// backend returns the backend of the relay with the given name, if any
+func (h *HTTP) backend(name string) *httpBackend {
+	for _, b := range h.backends {
+		if b.name == name {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// requestBackend returns the backend named by the backend parameter,
+// answering the request with an error if there is none
+func (h *HTTP) requestBackend(w http.ResponseWriter, r *http.Request) *httpBackend {
+	name := r.URL.Query().Get("backend")
+	if name == "" {
+		jsonResponse(w, response{http.StatusBadRequest, "missing parameter: backend"})
+		return nil
+	}
+
+	b := h.backend(name)
+	if b == nil {
+		jsonResponse(w, response{http.StatusNotFound, fmt.Sprintf("unknown backend %q", name)})
+		return nil
+	}
+
+	return b
+}
+
+// requestRetryBuffer returns the retry buffer of the backend named
+// by the backend parameter, answering with an error if there is none
+func (h *HTTP) requestRetryBuffer(w http.ResponseWriter, r *http.Request) *retryBuffer {
+	b := h.requestBackend(w, r)
+	if b == nil {
+		return nil
+	}
+
+	rb := b.getRetryBuffer()
+	if rb == nil {
+		jsonResponse(w, response{http.StatusConflict, fmt.Sprintf("backend %q has no retry buffer", b.name)})
+	}
+
+	return rb
+}
+
+// handleBackendAdmin reports the status of a backend on /admin/backend,
+// and pauses, resumes or retries its retry buffer on the sub-paths
+func (h *HTTP) handleBackendAdmin(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	b := h.requestBackend(w, r)
+	if b == nil {
+		return
+	}
+	name := b.name
+
+	action := strings.TrimPrefix(r.URL.Path, "/admin/backend")
+	if action == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+			return
+		}
+
+		jsonResponse(w, response{http.StatusOK, b.status()})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	rb := h.requestRetryBuffer(w, r)
+	if rb == nil {
+		return
+	}
+
+	switch action {
+	case "/pause":
+		h.logger.Info("pausing backend", "backend", name)
+		rb.pause()
+	case "/resume":
+		h.logger.Info("resuming backend", "backend", name)
+		rb.resume()
+	case "/retry":
+		h.logger.Info("retrying backend", "backend", name)
+		rb.retryNow()
+	}
+
+	jsonResponse(w, response{http.StatusOK, b.status()})
+}
+
+// postBackend forwards a write to a backend in its own span
+func (h *HTTP) postBackend(ctx context.Context, b *httpBackend, buf []byte, query, auth, endpoint string) (*responseData, error) {
+	ctx, span := trace.StartSpan(ctx, tracing.SpanPost)
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("relay", h.Name()),
+		trace.StringAttribute("backend", b.name),
+		trace.Int64Attribute("bytes", int64(len(buf))),
+	)
+
+	logger := h.contextLogger(ctx).With("backend", b.name)
+
+	start := time.Now()
+	resp, err := b.post(ctx, buf, query, auth, endpoint)
+	tracing.SetResponse(span, statusCode(resp), err)
+
+	switch {
+	case err != nil:
+		logger.Error("problem posting to backend", "bytes", len(buf), "error", err)
+	case resp.StatusCode/100 == 5:
+		logger.Error("5xx response from backend", "status", resp.StatusCode)
+	default:
+		logger.Debug("write forwarded", "bytes", len(buf), "status", resp.StatusCode, "duration", time.Since(start))
+		if resp.StatusCode/100 == 2 {
+			accessEntryFrom(ctx).accepted(b.name)
+		}
+	}
+
+	return resp, err
+}
+
+// encodedWrite is the body and query string of a write in a given precision
+type encodedWrite struct {
+	buf   *bytes.Buffer
+	query string
+
+	// queued is the copy of buf held by the queues of the backends
+	queued []byte
+}
+
+// queuedBytes returns a copy of the body which outlives the request,
+// shared by the queues of all the backends
+func (w *encodedWrite) queuedBytes() []byte {
+	if w.queued == nil {
+		w.queued = append([]byte(nil), w.buf.Bytes()...)
+	}
+
+	return w.queued
+}
+
+// encodePoints returns the line protocol of points in the given precision
+func encodePoints(points models.Points, precision string) *bytes.Buffer {
+	buf := getBuf()
+	for _, p := range points {
+		// Those two functions never return any errors, let's just ignore the return value
+		_, _ = buf.WriteString(p.PrecisionString(precision))
+		_ = buf.WriteByte('\n')
+	}
+
+	return buf
+}
+
+// precisionQuery returns the normalized query string of a write
+// whose timestamps are in the given precision
+func precisionQuery(params url.Values, precision string) string {
+	q := make(url.Values, len(params))
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("precision", precision)
+
+	return q.Encode()
+}
+
+// samePrecision tells whether two precision parameters are the same,
+// nanoseconds being the precision of a write without any
+func samePrecision(a string, b string) bool {
+	norm := func(p string) string {
+		if p == "" || p == "ns" {
+			return "n"
+		}
+		return p
+	}
+
+	return norm(a) == norm(b)
+}
+
+// queued tells whether the writes are queued for the backends before being sent
+func (h *HTTP) queued() bool {
+	for _, b := range h.backends {
+		if b.queue != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// detach returns the context of the backend posts of a request,
+// which holds its span, request ID and access log entry but outlives
+// the request, the entry is held until the posts release it
+func detach(r *http.Request) context.Context {
+	ctx := tracing.Detach(r.Context())
+	if id := logging.RequestID(r.Context()); id != "" {
+		ctx = logging.WithRequestID(ctx, id)
+	}
+
+	if e := accessEntryFrom(r.Context()); e != nil {
+		e.hold()
+		ctx = withAccessEntry(ctx, e)
+	}
+
+	return ctx
+}
+
+// contextLogger returns the logger of the relay, with the request ID held by ctx
+func (h *HTTP) contextLogger(ctx context.Context) *logging.Logger {
+	if id := logging.RequestID(ctx); id != "" {
+		return h.logger.With("request_id", id)
+	}
+
+	return h.logger
+}
+
+// requestLogger returns the logger of the relay, with the ID of the request
+func (h *HTTP) requestLogger(r *http.Request) *logging.Logger {
+	return h.contextLogger(r.Context())
+}
+
+// readBody reads the body of a request into buf, stopping after limit bytes
+// if limit is positive, and tells whether some of the body is left to read.
+// The client is answered when the body cannot be read.
+func (h *HTTP) readBody(w http.ResponseWriter, r *http.Request, buf *bytes.Buffer, limit int64) (more bool, ok bool) {
+	var err error
+	if limit > 0 {
+		if _, err = io.CopyN(buf, r.Body, limit); err == nil {
+			return true, true
+		} else if err == io.EOF {
+			err = nil
+		}
+	} else {
+		_, err = buf.ReadFrom(r.Body)
+	}
+
+	if err != nil {
+		h.bodyError(w, r, err)
+		return false, false
+	}
+
+	return false, true
+}
+
+// bodyError answers a request whose body could not be read
+func (h *HTTP) bodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrBodyTooLarge) {
+		h.requestLogger(r).Warn("request body too large", "limit", h.maxBodySize)
+		jsonResponse(w, response{http.StatusRequestEntityTooLarge, ErrBodyTooLarge.Error()})
+		return
+	}
+
+	h.requestLogger(r).Warn("unable to read body", "error", err)
+	jsonResponse(w, response{http.StatusBadRequest, "unable to read body"})
+}
+
 func (h *HTTP) handleStandard(w http.ResponseWriter, r *http.Request, start time.Time) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
@@ -261,120 +643,226 @@ func (h *HTTP) handleStandard(w http.ResponseWriter, r *http.Request, start time
 		}
 	}
 
-	queryParams := r.URL.Query()
-	bodyBuf := getBuf()
-	_, _ = bodyBuf.ReadFrom(r.Body)
+	atomic.AddInt64(&h.counters.writes, 1)
 
-	precision := queryParams.Get("precision")
-	points, err := models.ParsePointsWithPrecision(bodyBuf.Bytes(), start, precision)
-	if err != nil {
+	bodyBuf := getBuf()
+	more, ok := h.readBody(w, r, bodyBuf, h.streamThreshold)
+	if !ok {
 		putBuf(bodyBuf)
-		log.Printf("parse points error: %s", err)
-		jsonResponse(w, response{http.StatusBadRequest, "unable to parse points"})
 		return
 	}
 
-	outBuf := getBuf()
-	for _, p := range points {
-		// Those two functions never return any errors, let's just ignore the return value
-		_, _ = outBuf.WriteString(p.PrecisionString(precision))
-		_ = outBuf.WriteByte('\n')
+	// Large writes are forwarded by chunks, without reading the whole body
+	if more {
+		h.streamWrite(w, r, start, bodyBuf)
+		return
 	}
 
-	// done with the input points
-	putBuf(bodyBuf)
+	resp, n, _, err := h.forwardWrite(r, start, bodyBuf)
+	accessEntryFrom(r.Context()).setPoints(n)
+	h.writeResponse(w, r, resp, err)
+}
+
+// writeResponse answers a write with the response of the backends,
+// or with the error of its points
+func (h *HTTP) writeResponse(w http.ResponseWriter, r *http.Request, resp *responseData, err error) {
+	switch {
+	case err != nil:
+		jsonResponse(w, response{http.StatusBadRequest, "unable to parse points"})
+
+	case resp == nil:
+		// Failed to make any valid request...
+		jsonResponse(w, response{http.StatusServiceUnavailable, "unable to write points"})
+
+	case resp.StatusCode/100 == 4:
+		// User error
+		w.Header().Set("Content-Type", "text/plain")
+		resp.Write(w)
+
+	case resp.StatusCode == http.StatusAccepted:
+		// Status accepted means buffering or queued
+		h.requestLogger(r).Debug("write accepted before being sent")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// forwardWrite parses the points of a write held by body, which it owns, and
+// sends them to the backends. It returns the first 2xx or 4xx response of the
+// backends, nil if they all failed, along with the number of points and a
+// channel closed once every backend answered or buffered the write.
+func (h *HTTP) forwardWrite(r *http.Request, start time.Time, body *bytes.Buffer) (*responseData, int, <-chan struct{}, error) {
+	queryParams := r.URL.Query()
+	precision := queryParams.Get("precision")
+	passthrough := h.passthroughFor(precision)
+
+	var points models.Points
+	var n int
+	var err error
+
+	_, span := trace.StartSpan(r.Context(), tracing.SpanParse)
+	if passthrough {
+		n, err = scanLines(body, h.validateLines, start, precision)
+	} else {
+		points, err = models.ParsePointsWithPrecision(body.Bytes(), start, precision)
+		n = len(points)
+	}
+	span.AddAttributes(
+		trace.Int64Attribute("bytes", int64(body.Len())),
+		trace.Int64Attribute("points", int64(n)),
+		trace.BoolAttribute("passthrough", passthrough),
+	)
+	if err != nil {
+		tracing.SetError(span, err)
+	}
+	span.End()
+
+	if err != nil {
+		atomic.AddInt64(&h.counters.parseErrors, 1)
+		putBuf(body)
+		h.requestLogger(r).Warn("unable to parse points", "error", err)
+		return nil, n, nil, err
+	}
 
-	// normalize query string
-	query := queryParams.Encode()
+	metric.RecordPointsReceived(h.Name(), queryParams.Get("db"), n)
+	atomic.AddInt64(&h.counters.points, int64(n))
 
-	outBytes := outBuf.Bytes()
+	// normalize query string, the write keeps the precision of the client
+	// unless the backend normalizes it
+	clientWrite := &encodedWrite{buf: body, query: queryParams.Encode()}
+	if !passthrough {
+		clientWrite.buf = encodePoints(points, precision)
+	}
+	writes := map[string]*encodedWrite{"": clientWrite}
 
 	// check for authorization performed via the header
 	authHeader := r.Header.Get("Authorization")
 
+	// the backend posts outlive the client request
+	ctx := detach(r)
+
+	async := true
+	if h.queued() {
+		if async = h.asyncAck(); !async {
+			metric.RecordAsyncSync(h.Name())
+		}
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(len(h.backends))
 
 	var responses = make(chan *responseData, len(h.backends))
 
+	// taken is done once each backend answered or buffered the write
+	var taken sync.WaitGroup
+	taken.Add(len(h.backends))
+
 	for _, b := range h.backends {
 		b := b
 
+		var once sync.Once
+		release := func() { once.Do(taken.Done) }
+
 		// Don't do the request if the tags do not match the filters
+		_, span := trace.StartSpan(r.Context(), tracing.SpanFilter)
+		span.AddAttributes(trace.StringAttribute("backend", b.name))
 		err := b.validateRegexps(points)
+		span.AddAttributes(trace.BoolAttribute("accepted", err == nil))
+		span.End()
+
 		if err != nil {
-			if h.log {
-				h.logger.Printf("request invalidated by regular expression for backend: %s", b.name)
-				h.logger.Printf(err.Error())
-			}
+			metric.RecordPointsFiltered(h.Name(), b.name, len(points))
+			h.requestLogger(r).Debug("request invalidated by filters", "backend", b.name, "reason", err)
 
+			release()
 			wg.Done()
 			continue
 		}
 
+		key := ""
+		if b.precision != "" && !samePrecision(b.precision, precision) {
+			key = b.precision
+		}
+
+		write, ok := writes[key]
+		if !ok {
+			write = &encodedWrite{buf: encodePoints(points, key), query: precisionQuery(queryParams, key)}
+			writes[key] = write
+		}
+		outBytes, query := write.buf.Bytes(), write.query
+
+		if b.queue != nil {
+			qb, err := b.queue.enqueue(ctx, write.queuedBytes(), query, authHeader, b.endpoints.Write)
+			switch {
+			case err == nil && async:
+				responses <- &responseData{StatusCode: http.StatusAccepted}
+				release()
+				wg.Done()
+				continue
+
+			case err == nil:
+				go func() {
+					defer wg.Done()
+					defer release()
+					qb.wg.Wait()
+					if qb.resp != nil {
+						responses <- qb.resp
+					} else {
+						responses <- &responseData{}
+					}
+				}()
+				continue
+			}
+
+			// A full queue lets the write through
+			h.requestLogger(r).Debug("queue full, sending the write", "backend", b.name)
+		}
+
 		go func() {
 			defer wg.Done()
-			resp, err := b.post(outBytes, query, authHeader, b.endpoints.Write)
+			defer release()
+			resp, err := h.postBackend(withBuffered(ctx, release), b, outBytes, query, authHeader, b.endpoints.Write)
 			if err != nil {
-				log.Printf("Problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
-				if h.log {
-					h.logger.Printf("Content: %s", bodyBuf.String())
-				}
-
 				responses <- &responseData{}
 			} else {
-				if resp.StatusCode/100 == 5 {
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
-				}
 				responses <- resp
 			}
 		}()
 	}
 
+	done := make(chan struct{})
 	go func() {
-		wg.Wait()
-		close(responses)
-		putBuf(outBuf)
+		taken.Wait()
+		close(done)
 	}()
 
-	var errResponse *responseData
+	go func() {
+		wg.Wait()
+		close(responses)
+		for _, w := range writes {
+			putBuf(w.buf)
+		}
 
-	w.Header().Set("Content-Type", "text/plain")
+		// The parsed points hold slices of the body, which is only done
+		// with once every write is encoded
+		if !passthrough {
+			putBuf(body)
+		}
+		accessEntryFrom(ctx).release()
+	}()
 
 	for resp := range responses {
-
-		switch resp.StatusCode / 100 {
-		case 2:
-			// Status accepted means buffering,
-			if resp.StatusCode == http.StatusAccepted {
-				if h.log {
-					h.logger.Printf("could not reach relay %q, buffering...", h.Name())
-				}
-
-				w.WriteHeader(http.StatusAccepted)
-				return
-			}
-
-			w.WriteHeader(http.StatusNoContent)
-			return
-
-		case 4:
-			// User error
-			resp.Write(w)
-			return
-
-		default:
-			// Hold on to one of the responses to return back to the client
-			errResponse = nil
+		if c := resp.StatusCode / 100; c == 2 || c == 4 {
+			return resp, n, done, nil
 		}
 	}
 
 	// No successful writes
-	if errResponse == nil {
-		// Failed to make any valid request...
-		jsonResponse(w, response{http.StatusServiceUnavailable, "unable to write points"})
-		return
-	}
+	return nil, n, done, nil
 }
 
 func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
@@ -388,13 +876,21 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 		}
 	}
 
+	atomic.AddInt64(&h.counters.writes, 1)
+
 	authHeader := r.Header.Get("Authorization")
 
 	bodyBuf := getBuf()
-	_, _ = bodyBuf.ReadFrom(r.Body)
+	if _, ok := h.readBody(w, r, bodyBuf, 0); !ok {
+		putBuf(bodyBuf)
+		return
+	}
 
 	outBytes := bodyBuf.Bytes()
 
+	// the backend posts outlive the client request
+	ctx := detach(r)
+
 	var wg sync.WaitGroup
 	wg.Add(len(h.backends))
 
@@ -405,16 +901,10 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 
 		go func() {
 			defer wg.Done()
-			resp, err := b.post(outBytes, r.URL.RawQuery, authHeader, b.endpoints.PromWrite)
+			resp, err := h.postBackend(ctx, b, outBytes, r.URL.RawQuery, authHeader, b.endpoints.PromWrite)
 			if err != nil {
-				log.Printf("problem posting to relay %q backend %q: %v", h.Name(), b.name, err)
-
 				responses <- &responseData{}
 			} else {
-				if resp.StatusCode/100 == 5 {
-					log.Printf("5xx response for relay %q backend %q: %v", h.Name(), b.name, resp.StatusCode)
-				}
-
 				responses <- resp
 			}
 		}()
@@ -424,6 +914,7 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 		wg.Wait()
 		close(responses)
 		putBuf(bodyBuf)
+		accessEntryFrom(ctx).release()
 	}()
 
 	var errResponse *responseData
@@ -436,9 +927,8 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 		case 2:
 			// Status accepted means buffering,
 			if resp.StatusCode == http.StatusAccepted {
-				if h.log {
-					h.logger.Printf("could not reach relay %q, buffering...", h.Name())
-				}
+				h.requestLogger(r).Debug("could not reach a backend, buffering")
+
 				w.WriteHeader(http.StatusAccepted)
 				return
 			}
@@ -464,3 +954,255 @@ func (h *HTTP) handleProm(w http.ResponseWriter, r *http.Request, _ time.Time) {
 		return
 	}
 }
+
+// handleBuffer lists the batches held by the retry buffer of a backend
+func (h *HTTP) handleBuffer(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	rb := h.requestRetryBuffer(w, r)
+	if rb == nil {
+		return
+	}
+
+	jsonResponse(w, response{http.StatusOK, struct {
+		Backend string      `json:"backend"`
+		Batches []batchInfo `json:"batches"`
+	}{rb.backend, rb.list.infos()}})
+}
+
+// requestIDs returns the batch IDs given by the id parameters,
+// answering the request with an error if there are none
+func requestIDs(w http.ResponseWriter, r *http.Request) []uint64 {
+	var ids []uint64
+	for _, s := range r.URL.Query()["id"] {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			jsonResponse(w, response{http.StatusBadRequest, fmt.Sprintf("invalid batch id %q", s)})
+			return nil
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		jsonResponse(w, response{http.StatusBadRequest, "missing parameter: id"})
+	}
+
+	return ids
+}
+
+// handleBufferBatch returns the body of a buffered batch on GET,
+// and deletes the batches with the given IDs on DELETE
+func (h *HTTP) handleBufferBatch(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	rb := h.requestRetryBuffer(w, r)
+	if rb == nil {
+		return
+	}
+
+	ids := requestIDs(w, r)
+	if ids == nil {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleted := []uint64{}
+		for _, id := range ids {
+			if rb.delete(id) {
+				h.logger.Info("deleting buffered batch", "backend", rb.backend, "batch", id)
+				deleted = append(deleted, id)
+			}
+		}
+
+		if len(deleted) == 0 {
+			jsonResponse(w, response{http.StatusNotFound, "unknown batch"})
+			return
+		}
+
+		jsonResponse(w, response{http.StatusOK, struct {
+			Deleted []uint64 `json:"deleted"`
+		}{deleted}})
+		return
+	}
+
+	info, body, ok := rb.list.get(ids[0])
+	if !ok {
+		jsonResponse(w, response{http.StatusNotFound, "unknown batch"})
+		return
+	}
+
+	// The prometheus batches are snappy compressed protobuf
+	contentType := "text/plain; charset=utf-8"
+	if isProm(info.Endpoint) {
+		contentType = "application/x-protobuf"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// handleBufferExport writes the line protocol held by the retry buffer of
+// a backend, in the format of influx_inspect export, so that it can be
+// imported with influx -import
+func (h *HTTP) handleBufferExport(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	rb := h.requestRetryBuffer(w, r)
+	if rb == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, "# DML\n")
+
+	// Each batch is copied in turn, the ones sent in the meantime being skipped
+	var db, rp string
+	for _, info := range rb.list.infos() {
+		if isProm(info.Endpoint) {
+			continue
+		}
+
+		info, body, ok := rb.list.get(info.ID)
+		if !ok {
+			continue
+		}
+
+		if info.Database != db || info.RetentionPolicy != rp {
+			db, rp = info.Database, info.RetentionPolicy
+			fmt.Fprintf(w, "# CONTEXT-DATABASE: %s\n# CONTEXT-RETENTION-POLICY: %s\n", db, rp)
+		}
+
+		// The import applies a single precision to the whole export
+		created := time.Now().Add(-time.Duration(info.AgeMs) * time.Millisecond)
+		body, err := nanosecondLines(body, info.Precision, created)
+		if err != nil {
+			h.requestLogger(r).Warn("batch exported in its precision", "backend", rb.backend, "batch", info.ID,
+				"precision", info.Precision, "error", err)
+		}
+
+		_, _ = w.Write(body)
+	}
+}
+
+// nanosecondLines encodes the points of a body written in the given
+// precision with nanosecond timestamps, the points without timestamp getting
+// the time they were buffered. The body is returned as is if it does not parse.
+func nanosecondLines(body []byte, precision string, buffered time.Time) ([]byte, error) {
+	switch precision {
+	case "", "n", "ns":
+		return body, nil
+	}
+
+	points, err := models.ParsePointsWithPrecision(body, buffered, precision)
+	if err != nil {
+		return body, err
+	}
+
+	buf := encodePoints(points, "")
+	defer putBuf(buf)
+
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// requestDeadLetter returns the memory dead letter of the backend named
+// by the backend parameter, answering with an error if there is none
+func (h *HTTP) requestDeadLetter(w http.ResponseWriter, r *http.Request) *memoryDeadLetter {
+	rb := h.requestRetryBuffer(w, r)
+	if rb == nil {
+		return nil
+	}
+
+	d, ok := rb.deadLetter.(*memoryDeadLetter)
+	if !ok {
+		jsonResponse(w, response{http.StatusConflict, fmt.Sprintf("backend %q has no memory dead letter", rb.backend)})
+		return nil
+	}
+
+	return d
+}
+
+// handleDeadLetter lists the batches held by the memory dead letter of a backend
+func (h *HTTP) handleDeadLetter(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	d := h.requestDeadLetter(w, r)
+	if d == nil {
+		return
+	}
+
+	jsonResponse(w, response{http.StatusOK, struct {
+		Backend string             `json:"backend"`
+		Batches []*deadLetterEntry `json:"batches"`
+	}{r.URL.Query().Get("backend"), d.list()}})
+}
+
+// handleDeadLetterBatch returns the body of a batch of the memory dead
+// letter on GET, and deletes the batches with the given IDs on DELETE
+func (h *HTTP) handleDeadLetterBatch(w http.ResponseWriter, r *http.Request, _ time.Time) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		jsonResponse(w, response{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	d := h.requestDeadLetter(w, r)
+	if d == nil {
+		return
+	}
+
+	ids := requestIDs(w, r)
+	if ids == nil {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleted := []uint64{}
+		for _, id := range ids {
+			if d.remove(id) {
+				deleted = append(deleted, id)
+			}
+		}
+
+		if len(deleted) == 0 {
+			jsonResponse(w, response{http.StatusNotFound, "unknown batch"})
+			return
+		}
+
+		jsonResponse(w, response{http.StatusOK, struct {
+			Deleted []uint64 `json:"deleted"`
+		}{deleted}})
+		return
+	}
+
+	e := d.get(ids[0])
+	if e == nil {
+		jsonResponse(w, response{http.StatusNotFound, "unknown batch"})
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if isProm(e.Endpoint) {
+		contentType = "application/x-protobuf"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(e.body)
+}
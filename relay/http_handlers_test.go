@@ -2,20 +2,28 @@ package relay
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
 
 	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+	"github.com/strike-team/influxdb-relay/metric"
 )
 
+const basicStatus = `{"status":{"test":{"location":"","health":"unknown","writeOk":0,"writeFail":0,"bytes":0,"avgLatencyMs":0}},` +
+	`"relay":{"requests":0,"writes":0,"points":0,"parseErrors":0,"writeOk":0,"writeFail":0,"bytes":0}}`
+
 var (
 	ti         = time.Now()
 	promBody   = Body{}
@@ -46,10 +54,10 @@ var (
 		code: http.StatusMethodNotAllowed,
 	}
 	basicStatusWriter = &ResponseWriter{
-		writeBuf: bytes.NewBuffer([]byte("\"\\\"status\\\": {\\\"test\\\":{\\\"location\\\":\\\"\\\"}}\"")),
+		writeBuf: bytes.NewBuffer([]byte(basicStatus)),
 		header: http.Header{
 			"Content-Type":   []string{"application/json"},
-			"Content-Length": []string{"44"},
+			"Content-Length": []string{fmt.Sprint(len(basicStatus))},
 		},
 		code: http.StatusOK,
 	}
@@ -220,12 +228,21 @@ var (
 	}
 )
 
-func captureOutput(f func()) string {
+// captureOutput returns the messages logged by the relay, without their time
+func captureOutput(h *HTTP, f func()) string {
 	var buf bytes.Buffer
-	log.SetOutput(&buf)
+	logger := h.logger
+	h.logger = logging.New(&buf, config.LogLogfmt, logging.LevelInfo).With("relay", h.Name())
 	f()
-	log.SetOutput(os.Stderr)
-	return buf.String()
+	h.logger = logger
+
+	var lines []string
+	for _, l := range strings.SplitAfter(buf.String(), "\n") {
+		if i := strings.IndexByte(l, ' '); i >= 0 {
+			lines = append(lines, l[i+1:])
+		}
+	}
+	return strings.Join(lines, "")
 }
 
 var (
@@ -295,13 +312,77 @@ func TestHandleStatusSimple(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOut, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOut, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleStatus(w, r, ti)
 	WriterTest(t, basicStatusWriter, w)
 	h.backends = h.backends[:0]
 }
 
+func TestHandleStatusBackends(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"engine closed"}`, http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name: "status",
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "up", Location: up.URL},
+			{Name: "down", Location: down.URL},
+			{Name: "buffered", Location: down.URL, BufferSizeMB: 1, MaxDelayInterval: "1h"},
+		},
+	}, false)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewBufferString("cpu value=1\n")))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	get := func(url string) (int, status) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+
+		var st status
+		_ = json.Unmarshal(rec.Body.Bytes(), &st)
+		return rec.Code, st
+	}
+
+	// The relay answers with the first backend accepting the write
+	waitFor(t, func() bool {
+		_, st := get("/status")
+		return st.Relay.WriteFail >= 2 && st.Status["buffered"].Health == healthBuffering
+	})
+
+	code, st := get("/status")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(1), st.Relay.Writes)
+	assert.Equal(t, int64(1), st.Relay.Points)
+	assert.Equal(t, int64(1), st.Relay.WriteOk)
+
+	assert.Equal(t, healthUp, st.Status["up"].Health)
+	assert.NotNil(t, st.Status["up"].LastSuccess)
+	assert.NotZero(t, st.Status["up"].Bytes)
+
+	assert.Equal(t, healthDown, st.Status["down"].Health)
+	assert.NotNil(t, st.Status["down"].LastError)
+	assert.Equal(t, `500 response: {"error":"engine closed"}`, st.Status["down"].LastErrorMsg)
+
+	assert.Equal(t, healthBuffering, st.Status["buffered"].Health)
+
+	code, st = get("/status?backend=down")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, st.Status, 1)
+	assert.Equal(t, int64(1), st.Relay.WriteOk)
+
+	code, _ = get("/status?backend=nope")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
 func TestHandleStatusWrongMethod(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, emptyConfig, false)
@@ -348,13 +429,13 @@ func TestHandlePromBackendDown(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b2, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b2, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b2)
-	output := captureOutput(func() {
+	output := captureOutput(h, func() {
 		h.handleProm(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, "problem posting to relay \"http://\" backend \"test_prometheus\": Post : unsupported protocol scheme \"\"\n", output)
+	assert.Equal(t, `level=error msg="problem posting to backend" relay=http:// backend=test_prometheus bytes=0 error="Post \"\": unsupported protocol scheme \"\""
+`, output)
 	WriterTest(t, BackendDownPromWriter, w)
 	h.backends = h.backends[:0]
 }
@@ -369,7 +450,7 @@ func TestHandlePromBackendUp(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleProm(w, r, ti)
 	WriterTest(t, BackendUpPromWriter, w)
@@ -386,7 +467,7 @@ func TestHandlePromBackendUpError400(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleProm(w, r, ti)
 	WriterTest(t, BackendUpPromError400Writer, w)
@@ -403,13 +484,12 @@ func TestHandlePromBackendUpError500(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
-	output := captureOutput(func() {
+	output := captureOutput(h, func() {
 		h.handleProm(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, `5xx response for relay "http://" backend "test_prometheus": 500
+	assert.Equal(t, `level=error msg="5xx response from backend" relay=http:// backend=test_prometheus status=500
 `, output)
 	WriterTest(t, BackendUpPromError500Writer, w)
 	h.backends = h.backends[:0]
@@ -449,13 +529,13 @@ func TestHandleInfluxBackendDown(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutInflux, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutInflux, "", config.Filters{})
 	h.backends = append(h.backends, b)
-	output := captureOutput(func() {
+	output := captureOutput(h, func() {
 		h.handleStandard(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, "Problem posting to relay \"http://\" backend \"test_influx\": Post : unsupported protocol scheme \"\"\n", output)
+	assert.Equal(t, `level=error msg="problem posting to backend" relay=http:// backend=test_influx bytes=0 error="Post \"\": unsupported protocol scheme \"\""
+`, output)
 	WriterTest(t, BackendDownInfluxWriter, w)
 	h.backends = h.backends[:0]
 }
@@ -469,7 +549,7 @@ func TestHandleInfluxBackendUp(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleStandard(w, r, ti)
 	WriterTest(t, BackendUpInfluxWriter, w)
@@ -486,7 +566,7 @@ func TestHandleInfluxBackendUpError400(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleStandard(w, r, ti)
 	WriterTest(t, BackendUpInfluxError400Writer, w)
@@ -503,13 +583,12 @@ func TestHandleInfluxBackendUpError500(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
-	output := captureOutput(func() {
+	output := captureOutput(h, func() {
 		h.handleStandard(w, r, ti)
 	})
-	output = output[20:]
-	assert.Equal(t, `5xx response for relay "http://" backend "test_influx": 500
+	assert.Equal(t, `level=error msg="5xx response from backend" relay=http:// backend=test_influx status=500
 `, output)
 	WriterTest(t, BackendUpInfluxError500Writer, w)
 	h.backends = h.backends[:0]
@@ -525,7 +604,7 @@ func TestHandleInfluxFailParsePoint(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleStandard(w, r, ti)
 	WriterTest(t, InfluxFailParsePointWriter, w)
@@ -542,7 +621,7 @@ func TestHandleInfluxParsePoint(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, _ := newHTTPBackend(&cfgOutProm, config.Filters{})
+	b, _ := newHTTPBackend(&cfgOutProm, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleStandard(w, r, ti)
 	WriterTest(t, InfluxParsePointWriter, w)
@@ -561,7 +640,7 @@ func TestAdmin(t *testing.T) {
 
 	cfg := config.HTTPOutputConfig{Name: "test_influx", Location: ValidServer.URL + "/influxdb"}
 
-	b, _ := newHTTPBackend(&cfg, config.Filters{})
+	b, _ := newHTTPBackend(&cfg, "", config.Filters{})
 	h.backends = append(h.backends, b)
 	h.handleAdmin(w, r, ti)
 	WriterTest(t, AdminWriter, w)
@@ -606,7 +685,7 @@ func TestAdminErrorServer(t *testing.T) {
 
 	cfg := config.HTTPOutputConfig{Name: "test_influx", Location: Error500.URL + "/influxdb"}
 
-	b, _ := newHTTPBackend(&cfg, config.Filters{})
+	b, _ := newHTTPBackend(&cfg, "", config.Filters{})
 	h.backends = append(h.backends, b)
 
 	h.handleAdmin(w, r, ti)
@@ -625,7 +704,7 @@ func TestAdminErrorClient(t *testing.T) {
 
 	cfg := config.HTTPOutputConfig{Name: "test_influx", Location: Error400.URL + "/influxdb"}
 
-	b, _ := newHTTPBackend(&cfg, config.Filters{})
+	b, _ := newHTTPBackend(&cfg, "", config.Filters{})
 	h.backends = append(h.backends, b)
 
 	h.handleAdmin(w, r, ti)
@@ -634,3 +713,323 @@ func TestAdminErrorClient(t *testing.T) {
 	assert.Equal(t, buf[:43], buf2[:43])
 }
 
+
+func TestBackendAdmin(t *testing.T) {
+	h := createHTTP(t, config.HTTPConfig{
+		Name: "admin",
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "buffered", Location: ValidServer.URL, BufferSizeMB: 1},
+			{Name: "direct", Location: ValidServer.URL},
+		},
+	}, false)
+
+	call := func(method, url string) (int, backendStatus) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+
+		var st backendStatus
+		_ = json.Unmarshal(rec.Body.Bytes(), &st)
+		return rec.Code, st
+	}
+
+	code, st := call(http.MethodPost, "/admin/backend/pause?backend=buffered")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthPaused, st.Health)
+
+	code, st = call(http.MethodGet, "/admin/backend?backend=buffered")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthPaused, st.Health)
+
+	// Buffering until a batch is sent
+	code, st = call(http.MethodPost, "/admin/backend/resume?backend=buffered")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthBuffering, st.Health)
+
+	code, _ = call(http.MethodPost, "/admin/backend/retry?backend=buffered")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = call(http.MethodPost, "/admin/backend/pause?backend=direct")
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = call(http.MethodGet, "/admin/backend/pause?backend=buffered")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, _ = call(http.MethodPost, "/admin/backend/pause")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = call(http.MethodPost, "/admin/flush?backend=nope")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = call(http.MethodPost, "/admin/flush?backend=buffered")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestBufferAdmin(t *testing.T) {
+	h := createHTTP(t, config.HTTPConfig{
+		Name:    "buffer",
+		Outputs: []config.HTTPOutputConfig{{Name: "paused", Location: ValidServer.URL, BufferSizeMB: 1}},
+	}, false)
+
+	rb := h.backends[0].getRetryBuffer()
+	rb.pause()
+	defer rb.resume()
+
+	// The writes are posted one at a time, the first one being held by the
+	// paused worker while the two others wait in the list
+	for i, q := range []string{"db=a", "db=a", "db=b&rp=weekly"} {
+		go func(q string) {
+			_, _ = rb.post(context.Background(), []byte("cpu value=1\n"), q, "", "/write")
+		}(q)
+
+		i := i
+		waitFor(t, func() bool {
+			infos := rb.list.infos()
+			return len(infos) == i+1 && infos[0].Sending
+		})
+	}
+
+	call := func(method, url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		return rec
+	}
+
+	rec := call(http.MethodGet, "/admin/buffer?backend=paused")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var list struct {
+		Batches []batchInfo `json:"batches"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, list.Batches, 3) {
+		for i, info := range rb.list.infos() {
+			assert.Equal(t, info.ID, list.Batches[i].ID)
+			assert.Equal(t, info.Database, list.Batches[i].Database)
+		}
+	}
+	assert.True(t, list.Batches[0].Sending)
+
+	rec = call(http.MethodGet, "/admin/buffer/export?backend=paused")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "# DML\n# CONTEXT-DATABASE: ")
+	assert.Contains(t, rec.Body.String(), "# CONTEXT-DATABASE: b\n# CONTEXT-RETENTION-POLICY: weekly\ncpu value=1\n")
+
+	var weekly batchInfo
+	for _, info := range list.Batches {
+		if info.RetentionPolicy == "weekly" {
+			weekly = info
+		}
+	}
+	assert.Equal(t, "b", weekly.Database)
+
+	id := fmt.Sprint(weekly.ID)
+	rec = call(http.MethodGet, "/admin/buffer/batch?backend=paused&id="+id)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, weekly.Size, rec.Body.Len())
+	assert.True(t, strings.HasPrefix(rec.Body.String(), "cpu value=1\n"))
+
+	rec = call(http.MethodDelete, "/admin/buffer/batch?backend=paused&id="+id)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"deleted":[`+id+`]}`, rec.Body.String())
+
+	rec = call(http.MethodGet, "/admin/buffer/batch?backend=paused&id="+id)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = call(http.MethodGet, "/admin/buffer/batch?backend=paused&id=x")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestBufferExportPrecision(t *testing.T) {
+	h := createHTTP(t, config.HTTPConfig{
+		Name:    "buffer",
+		Outputs: []config.HTTPOutputConfig{{Name: "paused", Location: ValidServer.URL, BufferSizeMB: 1}},
+	}, false)
+
+	rb := h.backends[0].getRetryBuffer()
+	rb.pause()
+	defer rb.resume()
+
+	for i, w := range []struct {
+		query string
+		body  string
+	}{
+		{"db=a", "cpu value=1 1\n"},
+		{"db=a&precision=s", "cpu value=2 2\n"},
+		{"db=a&precision=ms", "cpu value=3 3\n"},
+	} {
+		go func(query, body string) {
+			_, _ = rb.post(context.Background(), []byte(body), query, "", "/write")
+		}(w.query, w.body)
+
+		i := i
+		waitFor(t, func() bool { return len(rb.list.infos()) == i+1 })
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/buffer/export?backend=paused", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The import applies a single precision, nanoseconds by default
+	assert.Equal(t, "# DML\n# CONTEXT-DATABASE: a\n# CONTEXT-RETENTION-POLICY: \n"+
+		"cpu value=1 1\ncpu value=2 2000000000\ncpu value=3 3000000\n", rec.Body.String())
+
+	body, err := nanosecondLines([]byte("cpu value=1\n"), "s", time.Unix(10, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu value=1 10000000000\n", string(body))
+}
+
+func TestServeMetricsOnRelay(t *testing.T) {
+	h := createHTTP(t, config.HTTPConfig{MetricsPath: "/relay-metrics"}, false)
+
+	metric.RecordPointsReceived("metrics-relay", "db", 1)
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/relay-metrics", nil))
+		return rec
+	}
+
+	// The views are aggregated asynchronously
+	waitFor(t, func() bool {
+		return strings.Contains(get().Body.String(), `relay_points_received{database="db",relay="metrics-relay"} 1`)
+	})
+
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "go_goroutines ")
+	assert.Contains(t, rec.Body.String(), "process_start_time_seconds ")
+
+	_, err := NewHTTP(config.HTTPConfig{MetricsPath: "/write"}, false, config.Filters{})
+	assert.Error(t, err)
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+
+	traceparent := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name:    "traced",
+		Outputs: []config.HTTPOutputConfig{{Name: "influx", Location: backend.URL}},
+	}, false)
+
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewBufferString("cpu value=1\n"))
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	rec := httptest.NewRecorder()
+	metric.HTTPHandler(h).ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	header := <-traceparent
+	assert.True(t, strings.HasPrefix(header, "00-4bf92f3577b34da6a3ce929d0e0e4736-"), header)
+	assert.NotContains(t, header, "00f067aa0ba902b7")
+}
+
+func TestHandleInfluxPrecision(t *testing.T) {
+	type write struct {
+		query string
+		body  string
+	}
+
+	server := func(received chan write) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- write{r.URL.RawQuery, string(body)}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	client, normalized := make(chan write, 1), make(chan write, 1)
+	clientServer, normalizedServer := server(client), server(normalized)
+	defer clientServer.Close()
+	defer normalizedServer.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "client", Location: clientServer.URL},
+			{Name: "normalized", Location: normalizedServer.URL, Precision: "s"},
+		},
+	}, false)
+
+	// The point without timestamp gets the time the write was received
+	start := time.Unix(10, 250*int64(time.Millisecond))
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test&precision=ms", strings.NewReader("cpu v=1 2500\ncpu v=2\n"))
+	rec := httptest.NewRecorder()
+	h.handleStandard(rec, r, start)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	assert.Equal(t, write{"db=test&precision=ms", "cpu v=1 2500\ncpu v=2 10250\n"}, <-client)
+	assert.Equal(t, write{"db=test&precision=s", "cpu v=1 2\ncpu v=2 10\n"}, <-normalized)
+}
+
+func TestHandleInfluxPrecisionConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]string)
+	server := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			received[name+" "+r.URL.Query().Get("db")] = string(body)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	clientServer, normalizedServer := server("client"), server("normalized")
+	defer clientServer.Close()
+	defer normalizedServer.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "client", Location: clientServer.URL},
+			{Name: "normalized", Location: normalizedServer.URL, Precision: "ns"},
+		},
+	}, false)
+
+	// The points are encoded for each output from the body of their write,
+	// which must not be reused in the meantime, by the encoding of the
+	// longer nanosecond timestamps or by the other writes
+	const writes = 50
+	lines := func(i int, suffix string) string {
+		var b strings.Builder
+		for j := 1; j <= 3; j++ {
+			fmt.Fprintf(&b, "cpu%d,host=server%d v=%d %d%s\n", i, j, j, i, suffix)
+		}
+		return b.String()
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= writes; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/write?db=db%d&precision=s", i), strings.NewReader(lines(i, "")))
+			rec := httptest.NewRecorder()
+			h.handleStandard(rec, r, time.Now())
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+		}()
+	}
+	wg.Wait()
+
+	// A write is answered once one of the outputs wrote it
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2*writes
+	})
+
+	for i := 1; i <= writes; i++ {
+		db := fmt.Sprintf("db%d", i)
+		assert.Equal(t, lines(i, ""), received["client "+db])
+		assert.Equal(t, lines(i, "000000000"), received["normalized "+db])
+	}
+}
@@ -2,8 +2,11 @@ package relay
 
 import (
 	"compress/gzip"
+	"io"
 	"net/http"
 	"time"
+
+	"github.com/strike-team/influxdb-relay/logging"
 )
 
 func allMiddlewares(h *HTTP, handlerFunc relayHandlerFunc) relayHandlerFunc {
@@ -17,9 +20,17 @@ func allMiddlewares(h *HTTP, handlerFunc relayHandlerFunc) relayHandlerFunc {
 
 func (h *HTTP) logMiddleWare(next relayHandlerFunc) relayHandlerFunc {
 	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
-		if h.log {
-			h.logger.Println("got request on: " + r.URL.Path)
+		// Reuse the ID set by the client or a proxy, so that
+		// the logs of each component can be correlated
+		id := r.Header.Get(logging.RequestIDHeader)
+		if id == "" {
+			id = logging.NewRequestID()
 		}
+
+		w.Header().Set(logging.RequestIDHeader, id)
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
+
+		h.logger.Debug("request received", "request_id", id, "method", r.Method, "path", r.URL.Path)
 		next(h, w, r, start)
 	})
 }
@@ -38,11 +49,47 @@ func (h *HTTP) bodyMiddleWare(next relayHandlerFunc) relayHandlerFunc {
 			body = b
 		}
 
+		if h.maxBodySize > 0 {
+			// The size of a compressed body is only known once read
+			if r.Header.Get("Content-Encoding") != "gzip" && r.ContentLength > h.maxBodySize {
+				jsonResponse(w, response{http.StatusRequestEntityTooLarge, ErrBodyTooLarge.Error()})
+				return
+			}
+
+			body = &limitedBody{ReadCloser: body, left: h.maxBodySize}
+		}
+
 		r.Body = body
 		next(h, w, r, start)
 	})
 }
 
+// limitedBody fails the reads of a request body past its maximum size
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, ErrBodyTooLarge
+	}
+
+	// Reading one more byte tells a body of the maximum size from a larger one
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.left {
+		n, l.left = int(l.left), -1
+		return n, ErrBodyTooLarge
+	}
+
+	l.left -= int64(n)
+	return n, err
+}
+
 func (h *HTTP) queryMiddleWare(next relayHandlerFunc) relayHandlerFunc {
 	return relayHandlerFunc(func(h *HTTP, w http.ResponseWriter, r *http.Request, start time.Time) {
 		queryParams := r.URL.Query()
@@ -10,6 +10,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
 	"time"
 )
 
@@ -143,22 +144,24 @@ func TestLogMiddleware(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, config.HTTPConfig{}, true)
 
-	h.logger = log.New(logger, "", 0)
+	h.logger = logging.New(logger, config.LogLogfmt, logging.LevelDebug)
 	handler := h.logMiddleWare((*HTTP).End)
 	r, err := http.NewRequest("", "influxdb", emptyBody)
 	if err != nil {
 		t.Fatal(err)
 	}
+	r.Header.Set(logging.RequestIDHeader, "42")
 	handler(h, w, r, ti)
 	buf, _ := ioutil.ReadAll(logger.buffer)
-	assert.Equal(t, string(buf), "got request on: influxdb\n")
+	assert.Contains(t, string(buf), ` level=debug msg="request received" request_id=42 method=GET path=influxdb`)
+	assert.Equal(t, "42", w.Header().Get(logging.RequestIDHeader))
 }
 
 func TestLogMiddlewareNoLog(t *testing.T) {
 	defer resetWriter()
 	h := createHTTP(t, config.HTTPConfig{}, false)
 
-	h.logger = log.New(logger, "", 0)
+	h.logger = logging.New(logger, config.LogLogfmt, logging.LevelInfo)
 	handler := h.logMiddleWare((*HTTP).End)
 	r, err := http.NewRequest("", "influxdb", emptyBody)
 	if err != nil {
@@ -0,0 +1,253 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+)
+
+// MonitorMeasurement is the measurement holding the statistics of the relay
+const MonitorMeasurement = "_relay"
+
+// relayCounters are the cumulative statistics of a relay
+// Requests are HTTP requests or UDP packets
+type relayCounters struct {
+	requests    int64
+	writes      int64
+	points      int64
+	parseErrors int64
+}
+
+// backendCounters are the cumulative statistics of the writes sent
+// to a backend, latency is the total time spent writing
+type backendCounters struct {
+	writeOk    int64
+	writeFail  int64
+	writeBytes int64
+	latency    int64
+
+	// outcome of the last writes, shown by /status
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   time.Time
+	lastErrMsg  string
+}
+
+// record counts a write, err being nil when the backend accepted it
+func (c *backendCounters) record(size int, latency time.Duration, err error) {
+	now := time.Now()
+	c.mu.Lock()
+	if err == nil {
+		c.lastSuccess = now
+	} else {
+		c.lastError, c.lastErrMsg = now, err.Error()
+	}
+	c.mu.Unlock()
+
+	if err == nil {
+		atomic.AddInt64(&c.writeOk, 1)
+	} else {
+		atomic.AddInt64(&c.writeFail, 1)
+	}
+
+	atomic.AddInt64(&c.writeBytes, int64(size))
+	atomic.AddInt64(&c.latency, int64(latency))
+}
+
+// last returns the time of the last success and of the last
+// error, along with its message
+func (c *backendCounters) last() (time.Time, time.Time, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastSuccess, c.lastError, c.lastErrMsg
+}
+
+func (c *backendCounters) fields() models.Fields {
+	return models.Fields{
+		"writeOk":    atomic.LoadInt64(&c.writeOk),
+		"writeFail":  atomic.LoadInt64(&c.writeFail),
+		"writeBytes": atomic.LoadInt64(&c.writeBytes),
+		"latencyNs":  atomic.LoadInt64(&c.latency),
+	}
+}
+
+func (c *relayCounters) fields() models.Fields {
+	return models.Fields{
+		"requests":    atomic.LoadInt64(&c.requests),
+		"writeReq":    atomic.LoadInt64(&c.writes),
+		"pointsRx":    atomic.LoadInt64(&c.points),
+		"parseErrors": atomic.LoadInt64(&c.parseErrors),
+	}
+}
+
+// Monitor periodically writes the statistics of the relays into
+// an InfluxDB output, in the same way as the _internal database
+type Monitor struct {
+	interval time.Duration
+	query    string
+	endpoint string
+	hostname string
+	relays   []Relay
+
+	p poster
+
+	done chan struct{}
+	stop sync.Once
+}
+
+// NewMonitor creates a monitor writing the statistics
+// of the given relays into the out output
+func NewMonitor(cfg config.MonitorConfig, out config.HTTPOutputConfig, relays []Relay) (*Monitor, error) {
+	interval := config.DefaultMonitorInterval
+	if cfg.Interval != "" {
+		i, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing monitor interval '%v'", err)
+		}
+		interval = i
+	}
+
+	timeout := DefaultHTTPTimeout
+	if out.Timeout != "" {
+		t, err := time.ParseDuration(out.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing HTTP timeout '%v'", err)
+		}
+		timeout = t
+	}
+
+	db := cfg.Database
+	if db == "" {
+		db = config.DefaultMonitorDatabase
+	}
+
+	params := url.Values{}
+	params.Set("db", db)
+	if cfg.RetentionPolicy != "" {
+		params.Set("rp", cfg.RetentionPolicy)
+	}
+
+	hostname, _ := os.Hostname()
+
+	// Always report the relays in the same order
+	relays = append([]Relay(nil), relays...)
+	sort.Slice(relays, func(i, j int) bool { return relays[i].Name() < relays[j].Name() })
+
+	return &Monitor{
+		interval: interval,
+		query:    params.Encode(),
+		endpoint: writeEndpoint(out),
+		hostname: hostname,
+		relays:   relays,
+		p:        newOutputPoster(out, timeout),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Run writes the statistics at every interval until the monitor is stopped
+func (m *Monitor) Run() error {
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return nil
+		case now := <-t.C:
+			if err := m.write(now); err != nil {
+				logging.Default().Error("error writing relay statistics", "error", err)
+			}
+		}
+	}
+}
+
+// Stop stops the monitor
+func (m *Monitor) Stop() error {
+	m.stop.Do(func() { close(m.done) })
+	return nil
+}
+
+func (m *Monitor) write(now time.Time) error {
+	var buf bytes.Buffer
+	for _, p := range m.points(now) {
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+
+	resp, err := m.p.post(context.Background(), buf.Bytes(), m.query, "", m.endpoint)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, resp.Body)
+	}
+
+	return nil
+}
+
+// points returns one point per relay and one point per backend
+func (m *Monitor) points(now time.Time) models.Points {
+	var points models.Points
+
+	add := func(tags map[string]string, fields models.Fields) {
+		if m.hostname != "" {
+			tags["hostname"] = m.hostname
+		}
+
+		p, err := models.NewPoint(MonitorMeasurement, models.NewTags(tags), fields, now)
+		if err != nil {
+			logging.Default().Error("error creating relay statistics", "error", err)
+			return
+		}
+
+		points = append(points, p)
+	}
+
+	for _, r := range m.relays {
+		switch r := r.(type) {
+		case *HTTP:
+			add(map[string]string{"type": "http", "relay": r.Name()}, r.counters.fields())
+
+			for _, b := range r.backends {
+				fields := models.Fields{}
+				if s := b.getSimplePoster(); s != nil {
+					fields = s.counters.fields()
+				}
+
+				if rb := b.getRetryBuffer(); rb != nil {
+					size, batches, _ := rb.list.state()
+					fields["buffering"] = int64(atomic.LoadInt32(&rb.buffering))
+					fields["bufferSize"] = int64(size)
+					fields["bufferBatches"] = int64(batches)
+					fields["bufferMaxSize"] = int64(rb.maxBuffered)
+				}
+
+				if len(fields) > 0 {
+					add(map[string]string{"type": "http", "relay": r.Name(), "backend": b.name}, fields)
+				}
+			}
+
+		case *UDP:
+			add(map[string]string{"type": "udp", "relay": r.Name()}, r.counters.fields())
+
+			for _, b := range r.backends {
+				add(map[string]string{"type": "udp", "relay": r.Name(), "backend": b.name}, b.counters.fields())
+			}
+		}
+	}
+
+	return points
+}
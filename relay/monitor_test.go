@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func TestMonitorWrite(t *testing.T) {
+	backend, _, _ := replayServer(http.StatusNoContent)
+	defer backend.Close()
+
+	monitoring, bodies, queries := replayServer(http.StatusNoContent)
+	defer monitoring.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Name:    "monitored",
+		Addr:    "127.0.0.1:0",
+		Outputs: []config.HTTPOutputConfig{{Name: "influx", Location: backend.URL, BufferSizeMB: 1}},
+	}, false)
+
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewBufferString("cpu value=1\ncpu value=2\n"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	m, err := NewMonitor(config.MonitorConfig{Enabled: true, RetentionPolicy: "weekly"},
+		config.HTTPOutputConfig{Location: monitoring.URL}, []Relay{h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.hostname = "host"
+
+	now := time.Unix(0, 42)
+	if err := m.write(now); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"db=_relay&rp=weekly"}, *queries)
+
+	lines := strings.Split(strings.TrimSpace((*bodies)[0]), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "_relay,hostname=host,relay=monitored,type=http parseErrors=0i,pointsRx=2i,requests=1i,writeReq=1i 42", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "_relay,backend=influx,hostname=host,relay=monitored,type=http "))
+	assert.Contains(t, lines[1], "writeOk=1i")
+	assert.Contains(t, lines[1], "writeFail=0i")
+	assert.Contains(t, lines[1], "writeBytes=64i")
+	assert.Contains(t, lines[1], "bufferSize=0i")
+	assert.Contains(t, lines[1], "bufferMaxSize=1048576i")
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// passthroughFor tells whether a write in the given precision is forwarded
+// as is, none of the backends having to handle its points
+func (h *HTTP) passthroughFor(precision string) bool {
+	if !h.passthrough {
+		return false
+	}
+
+	for _, b := range h.backends {
+		if b.precision != "" && !samePrecision(b.precision, precision) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scanLines counts the points of a write forwarded as is, checking that
+// each of them looks like a point if validate is set. The points without
+// timestamp get now in the given precision, as a parsed write, so that
+// they get the same time on every backend. The write is ended with a
+// newline, so that it can be batched with other writes.
+func scanLines(buf *bytes.Buffer, validate bool, now time.Time, precision string) (int, error) {
+	var stamp []byte
+	var out []byte
+
+	n := 0
+	data := buf.Bytes()
+	for i := 1; len(data) > 0; i++ {
+		raw := data
+		if end := bytes.IndexByte(data, '\n'); end >= 0 {
+			raw, data = data[:end+1], data[end+1:]
+		} else {
+			data = nil
+		}
+
+		line := bytes.TrimSpace(raw)
+		if len(line) == 0 || line[0] == '#' {
+			out = appendLine(out, raw)
+			continue
+		}
+
+		if validate && !validLine(line) {
+			return n, fmt.Errorf("unable to parse line %d: %q", i, line)
+		}
+		n++
+
+		if hasTimestamp(line) {
+			out = appendLine(out, raw)
+			continue
+		}
+
+		if out == nil {
+			// the lines up to this one are kept as they are
+			out = make([]byte, 0, buf.Len()+64)
+			out = append(out, buf.Bytes()[:len(buf.Bytes())-len(data)-len(raw)]...)
+		}
+		if stamp == nil {
+			stamp = strconv.AppendInt([]byte{' '}, now.UnixNano()/precisionUnit(precision), 10)
+		}
+
+		out = append(out, bytes.TrimRight(raw, " \t\r\n")...)
+		out = append(append(out, stamp...), '\n')
+	}
+
+	if out != nil {
+		buf.Reset()
+		_, _ = buf.Write(out)
+	}
+
+	if b := buf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+		_ = buf.WriteByte('\n')
+	}
+
+	return n, nil
+}
+
+// appendLine copies a line once the write is being rewritten
+func appendLine(out []byte, raw []byte) []byte {
+	if out == nil {
+		return nil
+	}
+
+	out = append(out, raw...)
+	if raw[len(raw)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// hasTimestamp tells whether a point ends with a timestamp: the fields
+// hold a '=' or end with a quote, so a last word of digits cannot be one
+func hasTimestamp(line []byte) bool {
+	i := len(line)
+	for i > 0 && line[i-1] >= '0' && line[i-1] <= '9' {
+		i--
+	}
+	if i == len(line) {
+		return false
+	}
+
+	if i > 0 && line[i-1] == '-' {
+		i--
+	}
+
+	return i > 0 && line[i-1] == ' '
+}
+
+// precisionUnit returns the nanoseconds of a unit of the given precision
+func precisionUnit(precision string) int64 {
+	switch precision {
+	case "u":
+		return int64(time.Microsecond)
+	case "ms":
+		return int64(time.Millisecond)
+	case "s":
+		return int64(time.Second)
+	case "m":
+		return int64(time.Minute)
+	case "h":
+		return int64(time.Hour)
+	default:
+		return 1
+	}
+}
+
+// validLine tells whether a line looks like a point: a measurement, its
+// tags, then at least one field separated by an unescaped space
+func validLine(line []byte) bool {
+	if line[0] == ',' || line[0] == ' ' {
+		return false
+	}
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ' ':
+			fields := line[i+1:]
+			eq := bytes.IndexByte(fields, '=')
+			return eq > 0 && eq < len(fields)-1
+		}
+	}
+
+	return false
+}
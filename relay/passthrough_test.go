@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func TestScanLines(t *testing.T) {
+	for _, tc := range []struct {
+		body     string
+		validate bool
+		points   int
+		out      string
+		err      bool
+	}{
+		{body: "cpu v=1 1\nmem,host=a v=2 10\n", points: 2, out: "cpu v=1 1\nmem,host=a v=2 10\n"},
+		{body: "cpu v=1 1\nmem,host=a v=2\n", points: 2, out: "cpu v=1 1\nmem,host=a v=2 42\n"},
+		{body: "# comment\n\ncpu v=1", points: 1, out: "# comment\n\ncpu v=1 42\n"},
+		{body: "cpu s=\"a b\" \ncpu s=\"a\\\" b\" 1", points: 2, out: "cpu s=\"a b\" 42\ncpu s=\"a\\\" b\" 1\n"},
+		{body: "not a point\n", points: 1, out: "not a point 42\n"},
+		{body: "cpu\\ load v=1\n", validate: true, points: 1, out: "cpu\\ load v=1 42\n"},
+		{body: "cpu v=1\nnot-a-point\n", validate: true, err: true},
+		{body: "cpu\\ v=1\n", validate: true, err: true},
+		{body: ",host=a v=1\n", validate: true, err: true},
+		{body: "cpu v=\n", validate: true, err: true},
+	} {
+		buf := bytes.NewBufferString(tc.body)
+		n, err := scanLines(buf, tc.validate, time.Unix(0, 42), "")
+		if tc.err {
+			assert.Error(t, err, tc.body)
+			continue
+		}
+
+		assert.NoError(t, err, tc.body)
+		assert.Equal(t, tc.points, n, tc.body)
+		assert.Equal(t, tc.out, buf.String())
+	}
+}
+
+func TestHandleInfluxPassthrough(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.URL.RawQuery + " " + string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	cfg := config.HTTPConfig{
+		Passthrough: true,
+		Outputs:     []config.HTTPOutputConfig{{Name: "influx", Location: backend.URL}},
+	}
+	h := createHTTP(t, cfg, false)
+
+	// The write is sent as is, the points without timestamp getting
+	// the time the relay received them
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test&precision=s", strings.NewReader("cpu,host=a  v=1 1\ncpu v=2"))
+	rec := httptest.NewRecorder()
+	h.handleStandard(rec, r, time.Unix(1577836800, 5))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "db=test&precision=s cpu,host=a  v=1 1\ncpu v=2 1577836800\n", <-received)
+	assert.Equal(t, int64(2), h.counters.points)
+
+	// An output without precision is in nanoseconds, as the writes without
+	h.backends[0].precision = "n"
+	r = httptest.NewRequest(http.MethodPost, "/write?db=test", strings.NewReader("cpu v=1 1"))
+	h.handleStandard(httptest.NewRecorder(), r, time.Now())
+	assert.Equal(t, "db=test cpu v=1 1\n", <-received)
+	assert.True(t, h.passthroughFor(""))
+
+	// An output normalizing another precision needs the points
+	h.backends[0].precision = "ms"
+	r = httptest.NewRequest(http.MethodPost, "/write?db=test&precision=s", strings.NewReader("cpu v=1 1"))
+	h.handleStandard(httptest.NewRecorder(), r, time.Now())
+	assert.Equal(t, "db=test&precision=ms cpu v=1 1000\n", <-received)
+
+	// So do the filters
+	fs := config.Filters{{TagRegexp: regexp.MustCompile("^host=a$"), Outputs: []string{"influx"}}}
+	hf, err := NewHTTP(cfg, false, fs)
+	assert.NoError(t, err)
+	assert.False(t, hf.(*HTTP).passthrough)
+}
+
+type nopPoster struct{}
+
+func (nopPoster) post(context.Context, []byte, string, string, string) (*responseData, error) {
+	return &responseData{StatusCode: http.StatusNoContent}, nil
+}
+
+// benchmarkHandleStandard measures the handling of a write of 1000 points,
+// sent to an output which does nothing
+func benchmarkHandleStandard(b *testing.B, cfg config.HTTPConfig) {
+	h, err := NewHTTP(cfg, false, config.Filters{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	relay := h.(*HTTP)
+	relay.backends = []*httpBackend{{poster: nopPoster{}, name: "nop"}}
+
+	var body bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&body, "cpu,host=server%02d,region=eu usage_user=%d.5,usage_system=12i,state=\"ok\" %d\n",
+			i%50, i, 1577836800000000000+int64(i)*int64(time.Second))
+	}
+
+	b.SetBytes(int64(body.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewReader(body.Bytes()))
+		rec := httptest.NewRecorder()
+		relay.handleStandard(rec, r, time.Now())
+		if rec.Code != http.StatusNoContent {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+func BenchmarkHandleStandardParse(b *testing.B) {
+	benchmarkHandleStandard(b, config.HTTPConfig{})
+}
+
+func BenchmarkHandleStandardPassthrough(b *testing.B) {
+	benchmarkHandleStandard(b, config.HTTPConfig{Passthrough: true})
+}
+
+func BenchmarkHandleStandardPassthroughValidate(b *testing.B) {
+	benchmarkHandleStandard(b, config.HTTPConfig{Passthrough: true, PassthroughValidate: true})
+}
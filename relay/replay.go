@@ -0,0 +1,422 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// Default replay settings
+const (
+	DefaultReplayAttempts = 5
+)
+
+// ReplayOptions describes how line protocol files are re-injected
+// into an HTTP output
+type ReplayOptions struct {
+	// Database and RetentionPolicy are used to build the write query of
+	// the files without # CONTEXT-DATABASE or # CONTEXT-RETENTION-POLICY
+	// header, as written by influx_inspect export or the dead letter
+	Database        string
+	RetentionPolicy string
+
+	// Precision of the timestamps found in the files without a
+	// # precision header (default: n), a file whose header
+	// disagrees with it is rejected
+	Precision string
+
+	// Authorization header forwarded to the output, if any
+	Auth string
+
+	// Only points within [Start, End) are replayed, zero values disable the bound
+	Start time.Time
+	End   time.Time
+
+	// Rate is the maximum number of points sent per second (0: unlimited)
+	Rate int
+
+	// BatchKB is the maximum size of a single write request (default: 512)
+	BatchKB int
+
+	// Attempts is the number of tries for each batch before giving up
+	Attempts int
+
+	// StateFile keeps track of the progress so an interrupted replay
+	// can be resumed where it stopped
+	StateFile string
+
+	// Logger receives progress messages, defaults to the standard logger
+	Logger *log.Logger
+}
+
+// ReplayReport sums up what has been done by Replay
+type ReplayReport struct {
+	Points   int
+	Skipped  int
+	Invalid  int
+	Batches  int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// replayState is persisted as JSON in the state file, it maps
+// each replayed file to the number of bytes already written
+type replayState struct {
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// replayContext is where the lines of a file are written
+type replayContext struct {
+	db        string
+	rp        string
+	precision string
+}
+
+func (c replayContext) query() string {
+	params := url.Values{}
+	params.Set("db", c.db)
+	if c.rp != "" {
+		params.Set("rp", c.rp)
+	}
+	params.Set("precision", c.precision)
+
+	return params.Encode()
+}
+
+type replayer struct {
+	p        poster
+	endpoint string
+	opts     ReplayOptions
+	limiter  *rate.Limiter
+	state    replayState
+	report   ReplayReport
+}
+
+// Replay reads the given line protocol files (plain or gzipped) and writes
+// their content to the HTTP output described by cfg
+func Replay(cfg config.HTTPOutputConfig, opts ReplayOptions, files []string) (ReplayReport, error) {
+	if opts.BatchKB <= 0 {
+		opts.BatchKB = DefaultBatchSizeKB
+	}
+
+	if opts.Attempts <= 0 {
+		opts.Attempts = DefaultReplayAttempts
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = log.New(os.Stderr, "replay: ", log.LstdFlags)
+	}
+
+	timeout := DefaultHTTPTimeout
+	if cfg.Timeout != "" {
+		t, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return ReplayReport{}, fmt.Errorf("error parsing HTTP timeout '%v'", err)
+		}
+		timeout = t
+	}
+
+	r := &replayer{
+		p:        newOutputPoster(cfg, timeout),
+		endpoint: writeEndpoint(cfg),
+		opts:     opts,
+		state:    replayState{Offsets: make(map[string]int64)},
+	}
+
+	if opts.Rate > 0 {
+		r.limiter = rate.NewLimiter(rate.Limit(opts.Rate), opts.Rate)
+	}
+
+	if err := r.loadState(); err != nil {
+		return r.report, err
+	}
+
+	start := time.Now()
+	for _, f := range files {
+		if err := r.replayFile(f); err != nil {
+			r.report.Duration = time.Since(start)
+			return r.report, fmt.Errorf("replaying %s: %v", f, err)
+		}
+	}
+
+	r.report.Duration = time.Since(start)
+	return r.report, nil
+}
+
+func (r *replayer) loadState() error {
+	if r.opts.StateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &r.state); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", r.opts.StateFile, err)
+	}
+
+	if r.state.Offsets == nil {
+		r.state.Offsets = make(map[string]int64)
+	}
+
+	return nil
+}
+
+// saveState atomically replaces the state file so an interruption
+// never leaves a truncated file behind
+func (r *replayer) saveState() error {
+	if r.opts.StateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := r.opts.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, r.opts.StateFile)
+}
+
+// openReplayFile returns a reader over the decompressed content of the file,
+// gzip is detected using the magic number rather than the extension
+func openReplayFile(name string) (io.Reader, io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+		return gz, f, nil
+	}
+
+	return br, f, nil
+}
+
+func (r *replayer) replayFile(name string) error {
+	key, err := filepath.Abs(name)
+	if err != nil {
+		key = name
+	}
+
+	in, c, err := openReplayFile(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := replayContext{db: r.opts.Database, rp: r.opts.RetentionPolicy, precision: r.opts.Precision}
+	if ctx.precision == "" {
+		ctx.precision = "n"
+	}
+
+	// The lines already written are read again for their headers
+	reader := bufio.NewReader(in)
+	done := r.state.Offsets[key]
+	if done > 0 {
+		r.opts.Logger.Printf("resuming %s at offset %d", name, done)
+	}
+
+	maxBatch := r.opts.BatchKB * KB
+	batch := new(bytes.Buffer)
+	var offset int64
+	points := 0
+
+	flush := func() error {
+		if batch.Len() > 0 {
+			if ctx.db == "" {
+				return errors.New("missing database, neither given nor set by a # CONTEXT-DATABASE header")
+			}
+
+			if err := r.send(batch.Bytes(), points, ctx.query()); err != nil {
+				return err
+			}
+		}
+
+		if offset > done {
+			r.state.Offsets[key] = offset
+		}
+		batch.Reset()
+		points = 0
+		return r.saveState()
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			next, header, herr := r.header(line, ctx)
+			if herr != nil {
+				return herr
+			}
+
+			switch {
+			case header:
+				// The lines already batched are written where they belong
+				if next != ctx && batch.Len() > 0 {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+				ctx = next
+
+			case offset >= done && r.accept(line, ctx.precision):
+				if batch.Len()+len(line) > maxBatch && batch.Len() > 0 {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+
+				batch.Write(bytes.TrimRight(line, "\r\n"))
+				batch.WriteByte('\n')
+				points++
+
+				if r.limiter != nil {
+					if err := r.limiter.Wait(context.Background()); err != nil {
+						return err
+					}
+				}
+			}
+
+			offset += int64(len(line))
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if offset < done {
+		return fmt.Errorf("unable to resume at offset %d: %v", done, io.ErrUnexpectedEOF)
+	}
+
+	return flush()
+}
+
+// header applies a context line, in the format of influx -import:
+// # CONTEXT-DATABASE: and # CONTEXT-RETENTION-POLICY: set where the next
+// lines are written, # precision: the precision of their timestamps
+func (r *replayer) header(line []byte, ctx replayContext) (replayContext, bool, error) {
+	text := string(bytes.TrimSpace(line))
+	value := func(prefix string) (string, bool) {
+		if !strings.HasPrefix(text, prefix) {
+			return "", false
+		}
+		return strings.TrimSpace(strings.TrimPrefix(text, prefix)), true
+	}
+
+	if db, ok := value("# CONTEXT-DATABASE:"); ok {
+		ctx.db = db
+		return ctx, true, nil
+	}
+
+	if rp, ok := value("# CONTEXT-RETENTION-POLICY:"); ok {
+		ctx.rp = rp
+		return ctx, true, nil
+	}
+
+	if precision, ok := value("# precision:"); ok {
+		if r.opts.Precision != "" && !samePrecision(precision, r.opts.Precision) {
+			return ctx, true, fmt.Errorf("file precision %q disagrees with %q", precision, r.opts.Precision)
+		}
+		ctx.precision = precision
+		return ctx, true, nil
+	}
+
+	return ctx, false, nil
+}
+
+// accept tells whether a line has to be replayed
+// Comments and empty lines are silently ignored
+func (r *replayer) accept(line []byte, precision string) bool {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] == '#' {
+		return false
+	}
+
+	ps, err := models.ParsePointsWithPrecision(trimmed, time.Now(), precision)
+	if err != nil || len(ps) != 1 {
+		r.report.Invalid++
+		r.opts.Logger.Printf("skipping invalid line: %q", trimmed)
+		return false
+	}
+
+	t := ps[0].Time()
+	if (!r.opts.Start.IsZero() && t.Before(r.opts.Start)) || (!r.opts.End.IsZero() && !t.Before(r.opts.End)) {
+		r.report.Skipped++
+		return false
+	}
+
+	return true
+}
+
+// send posts a batch to the output, retrying server side errors
+// Client errors are not retried as the data itself is at fault
+func (r *replayer) send(buf []byte, points int, query string) error {
+	interval := retryInitial
+	var lastErr error
+
+	for attempt := 1; attempt <= r.opts.Attempts; attempt++ {
+		resp, err := r.p.post(context.Background(), buf, query, r.opts.Auth, r.endpoint)
+		switch {
+		case err != nil:
+			lastErr = err
+
+		case resp.StatusCode/100 == 2:
+			r.report.Points += points
+			r.report.Batches++
+			r.report.Bytes += int64(len(buf))
+			return nil
+
+		case resp.StatusCode/100 == 4:
+			return fmt.Errorf("output rejected batch with status %d: %s", resp.StatusCode, bytes.TrimSpace(resp.Body))
+
+		default:
+			lastErr = fmt.Errorf("output answered with status %d", resp.StatusCode)
+		}
+
+		r.opts.Logger.Printf("attempt %d/%d failed: %v", attempt, r.opts.Attempts, lastErr)
+		if attempt < r.opts.Attempts {
+			time.Sleep(interval)
+			interval *= retryMultiplier
+		}
+	}
+
+	return lastErr
+}
@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+const replayData = `# some comment
+cpu value=1 1000000000
+cpu value=2 2000000000
+
+not a valid line
+cpu value=3 3000000000
+`
+
+func replayServer(status int) (*httptest.Server, *[]string, *[]string) {
+	var mu sync.Mutex
+	var bodies, queries []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+
+	return s, &bodies, &queries
+}
+
+func replayOptions() ReplayOptions {
+	return ReplayOptions{
+		Database: "db",
+		Logger:   log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func writeReplayFile(t *testing.T, dir, name string, compress bool) string {
+	path := filepath.Join(dir, name)
+	buf := new(bytes.Buffer)
+	if compress {
+		gz := gzip.NewWriter(buf)
+		_, _ = gz.Write([]byte(replayData))
+		_ = gz.Close()
+	} else {
+		buf.WriteString(replayData)
+	}
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestReplayPlainAndGzip(t *testing.T) {
+	s, bodies, queries := replayServer(http.StatusNoContent)
+	defer s.Close()
+
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		writeReplayFile(t, dir, "plain.lp", false),
+		writeReplayFile(t, dir, "archive.lp.gz", true),
+	}
+
+	report, err := Replay(config.HTTPOutputConfig{Location: s.URL}, replayOptions(), files)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, report.Points)
+	assert.Equal(t, 2, report.Invalid)
+	assert.Equal(t, 2, report.Batches)
+	assert.Equal(t, "cpu value=1 1000000000\ncpu value=2 2000000000\ncpu value=3 3000000000\n", (*bodies)[1])
+	assert.Equal(t, "db=db&precision=n", (*queries)[0])
+}
+
+func TestReplayTimeRange(t *testing.T) {
+	s, bodies, _ := replayServer(http.StatusNoContent)
+	defer s.Close()
+
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	opts := replayOptions()
+	opts.Start = time.Unix(2, 0)
+	opts.End = time.Unix(3, 0)
+
+	report, err := Replay(config.HTTPOutputConfig{Location: s.URL}, opts, []string{writeReplayFile(t, dir, "f.lp", false)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Points)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Equal(t, "cpu value=2 2000000000\n", (*bodies)[0])
+}
+
+func TestReplayResume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	file := writeReplayFile(t, dir, "f.lp", false)
+	opts := replayOptions()
+	opts.StateFile = filepath.Join(dir, "state.json")
+	opts.Attempts = 1
+
+	failing, _, _ := replayServer(http.StatusServiceUnavailable)
+	defer failing.Close()
+
+	_, err := Replay(config.HTTPOutputConfig{Location: failing.URL}, opts, []string{file})
+	assert.Error(t, err)
+
+	s, bodies, _ := replayServer(http.StatusNoContent)
+	defer s.Close()
+
+	report, err := Replay(config.HTTPOutputConfig{Location: s.URL}, opts, []string{file})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Points)
+
+	// Everything has been written, replaying again is a no-op
+	report, err = Replay(config.HTTPOutputConfig{Location: s.URL}, opts, []string{file})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Points)
+	assert.Equal(t, 1, len(*bodies))
+
+	state, _ := ioutil.ReadFile(opts.StateFile)
+	assert.True(t, strings.Contains(string(state), "f.lp"))
+}
+
+func TestReplayClientError(t *testing.T) {
+	s, bodies, _ := replayServer(http.StatusBadRequest)
+	defer s.Close()
+
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	_, err := Replay(config.HTTPOutputConfig{Location: s.URL}, replayOptions(), []string{writeReplayFile(t, dir, "f.lp", false)})
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(*bodies))
+}
+
+func TestReplayHeaders(t *testing.T) {
+	s, bodies, queries := replayServer(http.StatusNoContent)
+	defer s.Close()
+
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	// A dead letter file, written after the headers of its write
+	file := filepath.Join(dir, "relay_output_1.lp")
+	data := "# error: timeout\n# precision: s\n# DML\n# CONTEXT-DATABASE: telegraf\n# CONTEXT-RETENTION-POLICY: weekly\n" +
+		"cpu value=1 1\n# CONTEXT-DATABASE: other\ncpu value=2 2\n"
+	assert.NoError(t, ioutil.WriteFile(file, []byte(data), 0644))
+
+	opts := replayOptions()
+	opts.Start = time.Unix(1, 0)
+	report, err := Replay(config.HTTPOutputConfig{Location: s.URL}, opts, []string{file, writeReplayFile(t, dir, "f.lp", false)})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Points)
+
+	// The headers only apply to their file
+	assert.Equal(t, []string{"db=telegraf&precision=s&rp=weekly", "db=other&precision=s&rp=weekly", "db=db&precision=n"}, *queries)
+	assert.Equal(t, "cpu value=1 1\n", (*bodies)[0])
+
+	// A file whose precision is not the given one is rejected
+	opts.Precision = "ms"
+	_, err = Replay(config.HTTPOutputConfig{Location: s.URL}, opts, []string{file})
+	assert.Error(t, err)
+
+	// The database is required when the file does not tell it
+	opts = replayOptions()
+	opts.Database = ""
+	_, err = Replay(config.HTTPOutputConfig{Location: s.URL}, opts, []string{writeReplayFile(t, dir, "f.lp", false)})
+	assert.Error(t, err)
+	assert.Len(t, *bodies, 3)
+}
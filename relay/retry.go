@@ -2,91 +2,256 @@ package relay
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/time/rate"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+	"github.com/strike-team/influxdb-relay/metric"
+	"github.com/strike-team/influxdb-relay/tracing"
 )
 
 const (
-	retryInitial    = 500 * time.Millisecond
-	retryMultiplier = 2
+	retryInitial    = config.DefaultRetryInterval
+	retryMultiplier = config.DefaultRetryMultiplier
 )
 
 // Operation -TODO-
 type Operation func() error
 
 // Buffers and retries operations, if the buffer is full operations are dropped.
-// Only tries one operation at a time, the next operation is not attempted
+// Each worker tries one operation at a time, the next operation is not attempted
 // until success or timeout of the previous operation.
+// The operations of a database are attempted by a single worker at a time.
 // There is no delay between attempts of different operations.
 type retryBuffer struct {
 	buffering int32
 	flushing  int32
 
+	// paused backends buffer every write and retry none until resumed
+	paused int32
+
+	// wake is closed to interrupt the wait of the workers between two attempts
+	wakeMu sync.Mutex
+	wake   chan struct{}
+
 	initialInterval time.Duration
-	multiplier      time.Duration
+	multiplier      float64
 	maxInterval     time.Duration
 
 	maxBuffered int
 	maxBatch    int
 
+	// overflow is the policy applied to the writes which do not fit in the
+	// buffer, the block policy waiting up to overflowTimeout for room
+	overflow        string
+	overflowTimeout time.Duration
+
+	// batches out of attempts or older than maxAge are given up,
+	// split in halves first if split is set, zero meaning unlimited
+	maxAttempts int64
+	maxAge      time.Duration
+	split       bool
+	deadLetter  deadLetter
+
+	// drain keeps the backend buffering until its buffer is empty
+	drain bool
+
+	// limiter bounds the bytes per second sent from the buffer
+	limiter *rate.Limiter
+
+	// breaker is the circuit breaker of the backend, no batch
+	// is sent while it is open
+	breaker *circuitBreaker
+
 	list *bufferList
 
+	// relay and backend names, used to tag metrics
+	relay   string
+	backend string
+
+	logger *logging.Logger
+
 	p poster
 }
 
-func newRetryBuffer(size, batch int, max time.Duration, p poster) *retryBuffer {
+func newRetryBuffer(relay, backend string, size, batch int, max time.Duration, p poster) *retryBuffer {
 	r := &retryBuffer{
+		relay:           relay,
+		backend:         backend,
+		logger:          logging.Default().With("relay", relay, "backend", backend),
 		initialInterval: retryInitial,
 		multiplier:      retryMultiplier,
 		maxInterval:     max,
 		maxBuffered:     size,
 		maxBatch:        batch,
 		list:            newBufferList(size, batch),
+		wake:            make(chan struct{}),
 		p:               p,
 	}
-	go r.run()
+	r.start(1)
 	return r
 }
 
+// start runs n more workers sending the buffered batches
+func (r *retryBuffer) start(n int) {
+	for i := 0; i < n; i++ {
+		go r.run()
+	}
+}
+
 type retryStats struct {
-	Buffering int64 `json:"buffering"`
-	MaxSize   int64 `json:"maxSize"`
-	Size      int64 `json:"size"`
+	Buffering   int64 `json:"buffering"`
+	MaxSize     int64 `json:"maxSize"`
+	Size        int64 `json:"size"`
+	Batches     int64 `json:"batches"`
+	OldestAgeMs int64 `json:"oldestAgeMs"`
+	Paused      int64 `json:"paused"`
+	Spilled     int64 `json:"spilled,omitempty"`
 }
 
-func (r *retryBuffer) getStats() stats {
-	stats := retryStats{}
-	stats.Buffering = int64(r.buffering)
-	stats.MaxSize = int64(r.list.maxSize)
-	stats.Size = int64(r.list.size)
+func (r *retryBuffer) getStats() *retryStats {
+	size, batches, oldest := r.list.state()
+
+	stats := &retryStats{
+		Buffering: int64(atomic.LoadInt32(&r.buffering)),
+		MaxSize:   int64(r.list.maxSize),
+		Size:      int64(size),
+		Batches:   int64(batches),
+		Paused:    int64(atomic.LoadInt32(&r.paused)),
+		Spilled:   int64(r.list.spilledSize()),
+	}
+
+	if !oldest.IsZero() {
+		stats.OldestAgeMs = time.Since(oldest).Milliseconds()
+	}
+
 	return stats
 }
 
-func (r *retryBuffer) post(buf []byte, query string, auth string, endpoint string) (*responseData, error) {
-	if atomic.LoadInt32(&r.buffering) == 0 {
-		resp, err := r.p.post(buf, query, auth, endpoint)
-		// TODO: A 5xx caused by the point data could cause the relay to buffer forever
+func (r *retryBuffer) post(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	if atomic.LoadInt32(&r.buffering) == 0 && atomic.LoadInt32(&r.paused) == 0 {
+		resp, err := r.p.post(ctx, buf, query, auth, endpoint)
+		// A 5xx caused by the point data is buffered as well, max-attempts
+		// and max-age keep it from blocking the buffer forever
 		if err == nil && resp.StatusCode/100 != 5 {
 			return resp, err
 		}
 
-		atomic.StoreInt32(&r.buffering, 1)
+		if atomic.CompareAndSwapInt32(&r.buffering, 0, 1) {
+			r.logger.Warn("backend unavailable, buffering writes", "request_id", logging.RequestID(ctx))
+		}
 	}
 
 	// already buffering or failed request
-	batch, err := r.list.add(buf, query, auth, endpoint)
+	batch, err := r.buffer(ctx, buf, query, auth, endpoint)
+	r.recordState()
+	if err != nil {
+		metric.RecordBufferDropped(r.relay, r.backend, len(buf))
+		r.logger.Error("retry buffer full, dropping write", "request_id", logging.RequestID(ctx),
+			"bytes", len(buf), "policy", r.overflow, "error", err)
+		return &responseData{StatusCode: http.StatusServiceUnavailable}, err
+	}
+
+	// The caller may go on before the response, buf being held
+	// by the batch until sent
+	notifyBuffered(ctx)
+
+	// buf belongs to the request until the batch is done with it
+	batch.wg.Wait()
+
+	switch {
+	case batch.resp != nil && batch.resp.StatusCode/100 != 2:
+		return batch.resp, nil
+	case batch.resp == nil && !batch.split:
+		// Given up, flushed, deleted or evicted
+		return &responseData{StatusCode: http.StatusServiceUnavailable}, ErrBufferDropped
+	}
+
+	// The client receives a 202 telling the write went through the buffer
+	return &responseData{StatusCode: http.StatusAccepted}, nil
+}
+
+type bufferedKey struct{}
+
+// withBuffered returns a context telling the retry buffers
+// to call f once they hold the write
+func withBuffered(ctx context.Context, f func()) context.Context {
+	return context.WithValue(ctx, bufferedKey{}, f)
+}
+
+func notifyBuffered(ctx context.Context) {
+	if f, ok := ctx.Value(bufferedKey{}).(func()); ok {
+		f()
+	}
+}
+
+// buffer adds a write to the list, making room for it as told by the overflow policy
+func (r *retryBuffer) buffer(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*batch, error) {
+	buf, err := r.list.encode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.list.add(ctx, buf, query, auth, endpoint)
+	if err != ErrBufferFull {
+		return b, err
+	}
+
+	switch r.overflow {
+	case config.OverflowDropOldest:
+		for err == ErrBufferFull {
+			evicted := r.list.evict(len(buf))
+			if len(evicted) == 0 {
+				break
+			}
+
+			for _, e := range evicted {
+				metric.RecordBufferDropped(r.relay, r.backend, e.size)
+				r.logger.Warn("retry buffer full, dropping oldest batch", "request_ids", strings.Join(e.requestIDs, ","), "bytes", e.size)
+				e.wg.Done()
+			}
+
+			b, err = r.list.add(ctx, buf, query, auth, endpoint)
+		}
+
+	case config.OverflowBlock:
+		deadline := time.Now().Add(r.overflowTimeout)
+		for err == ErrBufferFull && r.list.waitRoom(len(buf), time.Until(deadline)) {
+			b, err = r.list.add(ctx, buf, query, auth, endpoint)
+		}
+
+	case config.OverflowSpill:
+		b, err = r.list.spill(ctx, buf, query, auth, endpoint)
+	}
+
+	return b, err
+}
 
-	if batch != nil {
-		defer batch.wg.Wait()
+// recordState publishes the current state of the buffer as metrics
+func (r *retryBuffer) recordState() {
+	size, batches, oldest := r.list.state()
+
+	var age time.Duration
+	if !oldest.IsZero() {
+		age = time.Since(oldest)
 	}
 
-	// We do not wait for the WaitGroup because we don't want
-	// to leave the connection open
-	// The client will receive a 204 which closes the connection and
-	// invites him to send further requests
-	return &responseData{StatusCode: http.StatusNoContent}, err
+	metric.RecordBufferState(r.relay, r.backend, size, batches, age)
 }
 
 func (r *retryBuffer) run() {
@@ -94,58 +259,413 @@ func (r *retryBuffer) run() {
 	for {
 		buf.Reset()
 		batch := r.list.pop()
+		r.recordState()
+
+		if err := batch.load(buf); err != nil {
+			metric.RecordBufferDropped(r.relay, r.backend, batch.size)
+			r.logger.Error("unable to read spilled batch, dropping it", "request_ids", strings.Join(batch.requestIDs, ","),
+				"bytes", batch.size, "error", err)
 
-		for _, b := range batch.bufs {
-			buf.Write(b)
+			r.list.done(batch)
+			batch.wg.Done()
+			r.recordState()
+			continue
 		}
 
 		interval := r.initialInterval
-		for {
-			if r.flushing == 1 {
+		if interval > r.maxInterval {
+			interval = r.maxInterval
+		}
+		for attempt := int64(1); ; attempt++ {
+			r.waitResumed(batch)
+
+			if atomic.LoadInt32(&batch.deleted) == 1 {
+				r.logger.Warn("buffered batch deleted", "request_ids", strings.Join(batch.requestIDs, ","), "bytes", batch.size)
+
+				r.list.done(batch)
+				batch.wg.Done()
+				r.recordState()
+				break
+			}
+
+			if atomic.LoadInt32(&r.flushing) == 1 {
+				r.logger.Warn("buffered batch flushed", "request_ids", strings.Join(batch.requestIDs, ","), "bytes", batch.size)
+
 				atomic.StoreInt32(&r.buffering, 0)
+				r.list.done(batch)
 				batch.wg.Done()
+				r.recordState()
 
-				if r.list.size == 0 {
+				if r.list.drained() {
 					atomic.StoreInt32(&r.flushing, 0)
 				}
 
 				break
 			}
 
-			resp, err := r.p.post(buf.Bytes(), batch.query, batch.auth, batch.endpoint)
+			// An open circuit is waited for without using up an attempt
+			if d := r.breaker.openFor(); d > 0 {
+				r.sleep(d)
+				attempt--
+				continue
+			}
+
+			r.throttle(buf.Len())
+
+			resp, err := r.attempt(batch, buf.Bytes(), attempt)
+			if err == ErrCircuitOpen {
+				// Another worker is probing the backend
+				r.sleep(jitter(r.initialInterval))
+				attempt--
+				continue
+			}
+			atomic.StoreInt64(&batch.attempts, attempt)
 			if err == nil && resp.StatusCode/100 != 5 {
+				r.logger.Debug("buffered batch sent", "request_ids", strings.Join(batch.requestIDs, ","),
+					"attempt", attempt, "status", resp.StatusCode)
+
 				batch.resp = resp
-				atomic.StoreInt32(&r.buffering, 0)
+				r.list.done(batch)
+				r.passthrough()
 				batch.wg.Done()
+				r.recordState()
 				break
 			}
 
+			// Given up, so that the next batches are sent
+			if r.exhausted(batch, attempt) {
+				batch.split = r.giveUp(batch, buf.Bytes(), attempt, resp, err)
+
+				r.list.done(batch)
+				batch.wg.Done()
+				r.recordState()
+				break
+			}
+
+			wait := jitter(interval)
+			kv := []interface{}{"request_ids", strings.Join(batch.requestIDs, ","), "attempt", attempt, "retry_in", wait}
+			if err != nil {
+				kv = append(kv, "error", err)
+			} else {
+				kv = append(kv, "status", resp.StatusCode)
+			}
+			r.logger.Warn("buffered batch not sent", kv...)
+
+			r.recordState()
+			r.sleep(wait)
+
+			// The first delay is the initial interval
 			if interval != r.maxInterval {
-				interval *= r.multiplier
+				interval = time.Duration(float64(interval) * r.multiplier)
 				if interval > r.maxInterval {
 					interval = r.maxInterval
 				}
 			}
+		}
+	}
+}
+
+// passthrough lets the new writes go straight to the backend once a batch is
+// sent, or once the buffer is empty when drain is set, so that the buffered
+// writes are not written after newer ones
+func (r *retryBuffer) passthrough() {
+	if !r.drain {
+		atomic.StoreInt32(&r.buffering, 0)
+		return
+	}
+
+	if r.list.drained() && atomic.CompareAndSwapInt32(&r.buffering, 1, 0) {
+		r.logger.Info("retry buffer drained, writes passed through")
+	}
+}
+
+// throttle waits until size bytes can be sent from the buffer
+func (r *retryBuffer) throttle(size int) {
+	if r.limiter == nil {
+		return
+	}
+
+	if size > r.limiter.Burst() {
+		size = r.limiter.Burst()
+	}
+
+	_ = r.limiter.WaitN(context.Background(), size)
+}
+
+// exhausted tells whether a batch is out of attempts or too old
+func (r *retryBuffer) exhausted(b *batch, attempt int64) bool {
+	return (r.maxAttempts > 0 && attempt >= r.maxAttempts) ||
+		(r.maxAge > 0 && time.Since(b.created) >= r.maxAge)
+}
+
+// giveUp splits a batch out of attempts, when the backend blamed the batch,
+// the batch holds several lines and its halves fit in the buffer, the batch
+// is moved to the dead letter otherwise
+// It tells whether the batch was split, its writes being still buffered
+func (r *retryBuffer) giveUp(b *batch, body []byte, attempt int64, resp *responseData, err error) bool {
+	expired := r.maxAge > 0 && time.Since(b.created) >= r.maxAge
+	if r.split && !expired && err == nil && rejected(resp) && !isProm(b.endpoint) {
+		if first, second, ok := splitLines(body); ok && r.list.pushHalves(b, first, second) {
+			r.logger.Warn("splitting buffered batch", "request_ids", strings.Join(b.requestIDs, ","),
+				"attempt", attempt, "status", resp.StatusCode, "bytes", len(body))
+			return true
+		}
+	}
 
-			time.Sleep(interval)
+	reason := responseError(resp, err)
+	metric.RecordBufferGivenUp(r.relay, r.backend, len(body))
+
+	if r.deadLetter == nil {
+		r.logger.Error("buffered batch given up, dropping it", "request_ids", strings.Join(b.requestIDs, ","),
+			"attempt", attempt, "bytes", len(body), "error", reason)
+		return false
+	}
+
+	if err := r.deadLetter.store(newDeadLetterEntry(b, body, attempt, reason)); err != nil {
+		r.logger.Error("unable to store buffered batch in the dead letter, dropping it", "request_ids", strings.Join(b.requestIDs, ","),
+			"bytes", len(body), "error", err)
+		return false
+	}
+
+	r.logger.Warn("buffered batch moved to the dead letter", "request_ids", strings.Join(b.requestIDs, ","),
+		"attempt", attempt, "bytes", len(body), "error", reason)
+	return false
+}
+
+// rejected tells whether a response blames the batch rather than the
+// availability of the backend, so that splitting the batch may isolate the
+// faulty lines: a 500 of the backend or a write or parse failure, unlike
+// the 502, 503 and 504 of a proxy in front of a backend which is down
+func rejected(resp *responseData) bool {
+	if resp.StatusCode == http.StatusInternalServerError {
+		return true
+	}
+
+	body := bytes.ToLower(resp.Body)
+	return bytes.Contains(body, []byte("partial write")) || bytes.Contains(body, []byte("unable to parse"))
+}
+
+// splitLines copies the first and second half of the lines of body,
+// ok being false if there is a single line
+func splitLines(body []byte) ([]byte, []byte, bool) {
+	lines := bytes.Count(bytes.TrimRight(body, "\n"), []byte("\n")) + 1
+	if lines < 2 {
+		return nil, nil, false
+	}
+
+	cut := 0
+	for i := 0; i < lines/2; i++ {
+		cut += bytes.IndexByte(body[cut:], '\n') + 1
+	}
+
+	return append([]byte(nil), body[:cut]...), append([]byte(nil), body[cut:]...), true
+}
+
+// half returns a batch holding part of the body of b, as old as b
+func (b *batch) half(body []byte) *batch {
+	h := newBatch(body, b.query, b.auth, b.endpoint)
+	h.created = b.created
+	h.spans = b.spans
+	h.requestIDs = b.requestIDs
+
+	// The writes received in the meantime are not merged into the halves
+	h.full = true
+	return h
+}
+
+// jitter returns a random delay between the half and the whole of d,
+// so that the workers and relays retrying at once spread their attempts
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// sleep waits for the next attempt, which retryNow brings forward
+func (r *retryBuffer) sleep(d time.Duration) {
+	wake := r.waker()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-wake:
+	}
+}
+
+// waitResumed blocks while the backend is paused,
+// unless its buffer is flushed or the batch deleted
+func (r *retryBuffer) waitResumed(b *batch) {
+	for {
+		wake := r.waker()
+		if atomic.LoadInt32(&r.paused) == 0 || atomic.LoadInt32(&r.flushing) == 1 || atomic.LoadInt32(&b.deleted) == 1 {
+			return
 		}
+		<-wake
+	}
+}
+
+// waker returns the channel closed by the next signal
+func (r *retryBuffer) waker() <-chan struct{} {
+	r.wakeMu.Lock()
+	defer r.wakeMu.Unlock()
+
+	return r.wake
+}
+
+// signal wakes all the workers up
+func (r *retryBuffer) signal() {
+	r.wakeMu.Lock()
+	close(r.wake)
+	r.wake = make(chan struct{})
+	r.wakeMu.Unlock()
+}
+
+// pause stops sending writes to the backend, they are buffered instead
+// and keep being buffered after resume until a batch is sent
+func (r *retryBuffer) pause() {
+	atomic.StoreInt32(&r.paused, 1)
+	atomic.StoreInt32(&r.buffering, 1)
+}
+
+// resume sends the buffered writes, then the new ones
+func (r *retryBuffer) resume() {
+	atomic.StoreInt32(&r.paused, 0)
+	r.signal()
+}
+
+// retryNow sends the pending batches without waiting for the retry interval
+func (r *retryBuffer) retryNow() {
+	r.signal()
+}
+
+// delete drops the batch with the given ID, telling whether it was found
+func (r *retryBuffer) delete(id uint64) bool {
+	if !r.list.remove(id) {
+		return false
+	}
+
+	r.signal()
+	r.recordState()
+	return true
+}
+
+// startSpan starts a span of the given name which belongs to the
+// trace of the first write of the batch and links the other ones
+func (b *batch) startSpan(name string) (context.Context, *trace.Span) {
+	if len(b.spans) == 0 {
+		return trace.StartSpan(context.Background(), name)
+	}
+
+	ctx, span := trace.StartSpanWithRemoteParent(context.Background(), name, b.spans[0])
+	for _, sc := range b.spans[1:] {
+		span.AddLink(trace.Link{TraceID: sc.TraceID, SpanID: sc.SpanID, Type: trace.LinkTypeParent})
 	}
+
+	return ctx, span
+}
+
+// attempt posts a buffered batch, in a span of the traces of its writes
+func (r *retryBuffer) attempt(b *batch, buf []byte, attempt int64) (*responseData, error) {
+	ctx, span := b.startSpan(tracing.SpanRetry)
+	defer span.End()
+
+	span.AddAttributes(
+		trace.StringAttribute("relay", r.relay),
+		trace.StringAttribute("backend", r.backend),
+		trace.Int64Attribute("attempt", attempt),
+		trace.Int64Attribute("bytes", int64(len(buf))),
+	)
+
+	resp, err := r.p.post(ctx, buf, b.query, b.auth, b.endpoint)
+	tracing.SetResponse(span, statusCode(resp), err)
+
+	return resp, err
 }
 
 type batch struct {
+	// id identifies the batch in the admin routes
+	id uint64
+
+	// attempts is the number of times the batch was sent
+	attempts int64
+
+	// deleted is set when the batch is deleted while being sent
+	deleted int32
+
 	query    string
 	auth     string
 	bufs     [][]byte
 	size     int
 	full     bool
 	endpoint string
+	created  time.Time
+
+	// spans are the contexts of the traced writes held by the batch
+	spans []trace.SpanContext
+
+	// requestIDs identify the writes held by the batch in the logs
+	requestIDs []string
+
+	// db is the database of the batch, whose batches are sent in order
+	db string
+
+	// path is the file holding the body of a spilled batch, after
+	// a header of skip bytes
+	path string
+	skip int
+
+	// compressed is set when the writes are held as gzip members
+	compressed bool
 
 	wg   sync.WaitGroup
 	resp *responseData
 
+	// err is the error of the post of a coalesced batch
+	err error
+
+	// split is set when the batch was given up in halves
+	split bool
+
 	next *batch
 }
 
+// load writes the body of the batch into buf
+func (b *batch) load(buf *bytes.Buffer) error {
+	var r io.Reader
+	if b.path == "" {
+		if !b.compressed {
+			for _, w := range b.bufs {
+				buf.Write(w)
+			}
+			return nil
+		}
+
+		members := make([]io.Reader, len(b.bufs))
+		for i, w := range b.bufs {
+			members[i] = bytes.NewReader(w)
+		}
+		r = io.MultiReader(members...)
+	} else {
+		data, err := ioutil.ReadFile(b.path)
+		if err != nil {
+			return err
+		}
+		if len(data) < b.skip {
+			return io.ErrUnexpectedEOF
+		}
+		data = data[b.skip:]
+
+		if !b.compressed {
+			buf.Write(data)
+			return nil
+		}
+		r = bytes.NewReader(data)
+	}
+
+	return gunzipTo(buf, r)
+}
+
 func newBatch(buf []byte, query string, auth string, endpoint string) *batch {
 	b := new(batch)
 	b.bufs = [][]byte{buf}
@@ -153,6 +673,10 @@ func newBatch(buf []byte, query string, auth string, endpoint string) *batch {
 	b.query = query
 	b.auth = auth
 	b.endpoint = endpoint
+	b.created = time.Now()
+	if params, err := url.ParseQuery(query); err == nil {
+		b.db = params.Get("db")
+	}
 	b.wg.Add(1)
 	return b
 }
@@ -163,6 +687,26 @@ type bufferList struct {
 	size     int
 	maxSize  int
 	maxBatch int
+
+	// batches is the number of batches in the list
+	batches int
+
+	// sending are the batches which have been popped and not done yet
+	sending []*batch
+
+	// lastID is the ID of the last batch created
+	lastID uint64
+
+	// the batches which do not fit in memory are spilled into spillDir,
+	// up to maxSpill bytes
+	spillDir    string
+	spillPrefix string
+	spilled     int
+	maxSpill    int
+
+	// compress gzips the writes at the given level before adding them
+	compress bool
+	level    int
 }
 
 func newBufferList(maxSize, maxBatch int) *bufferList {
@@ -173,32 +717,356 @@ func newBufferList(maxSize, maxBatch int) *bufferList {
 	}
 }
 
-
 // Empty the buffer to drop any buffered query
 // This allows to flush 'impossible' queries which loop infinitely
 // without having to restart the whole relay
 func (r *retryBuffer) empty() {
+	// Nothing to flush, the next batch must not be dropped
+	if size, _, oldest := r.list.state(); size == 0 && oldest.IsZero() {
+		return
+	}
+
 	atomic.StoreInt32(&r.flushing, 1)
+	r.signal()
 }
 
-// pop will remove and return the first element of the list, blocking if necessary
+// pop will remove and return the first element of the list whose database
+// has no batch being sent, blocking if necessary
 func (l *bufferList) pop() *batch {
 	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	for {
+		for cur := &l.head; *cur != nil; cur = &(*cur).next {
+			b := *cur
+			if l.isSending(b.db) {
+				continue
+			}
+
+			*cur = b.next
+			b.next = nil
+			l.unlink(b)
+			l.sending = append(l.sending, b)
+
+			// Wake up the writes waiting for room
+			l.cond.Broadcast()
+			return b
+		}
+
+		l.cond.Wait()
+	}
+}
+
+// popLingered removes and returns the first element of the list which is
+// full or whose first write waited for linger, blocking if necessary
+func (l *bufferList) popLingered(linger time.Duration) *batch {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	for {
+		wait := time.Duration(-1)
+		for cur := &l.head; *cur != nil; cur = &(*cur).next {
+			b := *cur
+			left := linger - time.Since(b.created)
+			if b.full || b.size >= l.maxBatch || left <= 0 {
+				*cur = b.next
+				b.next = nil
+				l.unlink(b)
+				return b
+			}
+
+			if wait < 0 || left < wait {
+				wait = left
+			}
+		}
 
-	for l.size == 0 {
+		if wait < 0 {
+			l.cond.Wait()
+			continue
+		}
+
+		t := time.AfterFunc(wait, l.cond.Broadcast)
 		l.cond.Wait()
+		t.Stop()
 	}
+}
 
-	b := l.head
-	l.head = l.head.next
-	l.size -= b.size
+// unlink accounts for a batch removed from the list
+func (l *bufferList) unlink(b *batch) {
+	if b.path != "" {
+		l.spilled -= b.size
+	} else {
+		l.size -= b.size
+	}
+	l.batches--
+}
 
-	l.cond.L.Unlock()
+func (l *bufferList) isSending(db string) bool {
+	for _, b := range l.sending {
+		if b.db == db {
+			return true
+		}
+	}
+	return false
+}
 
-	return b
+// pushHalves puts the halves of the body of b back at the head of the list,
+// held as the writes of the list, if they fit in the buffer
+func (l *bufferList) pushHalves(b *batch, first []byte, second []byte) bool {
+	var err error
+	if first, err = l.encode(first); err != nil {
+		return false
+	}
+	if second, err = l.encode(second); err != nil {
+		return false
+	}
+
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.size+len(first)+len(second) > l.maxSize {
+		return false
+	}
+
+	bs := []*batch{b.half(first), b.half(second)}
+	for _, h := range bs {
+		l.lastID++
+		h.id = l.lastID
+		h.compressed = l.compress
+		l.size += h.size
+		l.batches++
+	}
+
+	bs[1].next = l.head
+	bs[0].next = bs[1]
+	l.head = bs[0]
+
+	l.cond.Broadcast()
+	return true
+}
+
+// drained tells whether the list is empty, the batches being sent included
+func (l *bufferList) drained() bool {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	return l.head == nil && len(l.sending) == 0
+}
+
+// done tells the list a popped batch has been handled,
+// the next batch of its database can be sent
+func (l *bufferList) done(b *batch) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	for i, s := range l.sending {
+		if s == b {
+			l.sending = append(l.sending[:i], l.sending[i+1:]...)
+			break
+		}
+	}
+
+	if b.path != "" {
+		_ = os.Remove(b.path)
+	}
+
+	l.cond.Broadcast()
+}
+
+// encode returns the write as held by the list
+func (l *bufferList) encode(buf []byte) ([]byte, error) {
+	if !l.compress {
+		return buf, nil
+	}
+
+	var zbuf bytes.Buffer
+	if err := gzipTo(&zbuf, buf, l.level); err != nil {
+		return nil, err
+	}
+
+	return zbuf.Bytes(), nil
+}
+
+// spilledSize returns the size of the spilled batches still in the list
+func (l *bufferList) spilledSize() int {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	return l.spilled
+}
+
+// evict removes the oldest batches held in memory until size bytes fit,
+// no batch is removed if they would not fit anyway
+// The evicted batches are returned to be released by the caller
+func (l *bufferList) evict(size int) []*batch {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	free := l.maxSize - l.size
+	for b := l.head; b != nil && free < size; b = b.next {
+		if b.path == "" {
+			free += b.size
+		}
+	}
+
+	if free < size {
+		return nil
+	}
+
+	var evicted []*batch
+	for cur := &l.head; *cur != nil && l.size+size > l.maxSize; {
+		b := *cur
+		if b.path != "" {
+			cur = &b.next
+			continue
+		}
+
+		*cur = b.next
+		l.unlink(b)
+		evicted = append(evicted, b)
+	}
+
+	return evicted
+}
+
+// waitRoom waits until size bytes fit in the list,
+// telling whether they do before the timeout
+func (l *bufferList) waitRoom(size int, timeout time.Duration) bool {
+	if size > l.maxSize || timeout <= 0 {
+		return false
+	}
+
+	deadline := time.Now().Add(timeout)
+	t := time.AfterFunc(timeout, func() {
+		l.cond.L.Lock()
+		l.cond.Broadcast()
+		l.cond.L.Unlock()
+	})
+	defer t.Stop()
+
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	for l.size+size > l.maxSize {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		l.cond.Wait()
+	}
+
+	return true
+}
+
+// spill writes a write which does not fit in memory into its own
+// file, in a batch appended to the list
+func (l *bufferList) spill(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*batch, error) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	if l.spillDir == "" || l.spilled+len(buf) > l.maxSpill {
+		return nil, ErrBufferFull
+	}
+
+	b := newBatch(nil, query, auth, endpoint)
+	b.bufs = nil
+	b.size = len(buf)
+	b.full = true
+	b.id = l.lastID + 1
+	b.compressed = l.compress
+
+	if err := l.writeSpill(b, buf); err != nil {
+		return nil, err
+	}
+
+	var cur **batch
+	for cur = &l.head; *cur != nil; cur = &(*cur).next {
+		// prevent future writes from preceding this write
+		if (*cur).query == query && (*cur).auth == auth {
+			(*cur).full = true
+		}
+	}
+
+	*cur = b
+	l.lastID++
+	l.spilled += b.size
+	l.batches++
+	l.track(ctx, b)
+
+	l.cond.Broadcast()
+	return b, nil
 }
 
-func (l *bufferList) add(buf []byte, query string, auth string, endpoint string) (*batch, error) {
+// writeSpill writes the body of a spilled batch into a new file, after
+// the header of the dead letter files so that it may be replayed
+// The name holds the creation time of the batch, whose id restarts
+// with the relay, and an existing file is never overwritten
+func (l *bufferList) writeSpill(b *batch, buf []byte) error {
+	var data bytes.Buffer
+	ext := ".lp"
+	if isProm(b.endpoint) {
+		ext = ".pb"
+	} else {
+		params, _ := url.ParseQuery(b.query)
+		writeContext(&data, params.Get("precision"), params.Get("db"), params.Get("rp"))
+	}
+
+	if b.compressed {
+		ext += ".gz"
+		if data.Len() > 0 {
+			header, err := l.encode(data.Bytes())
+			if err != nil {
+				return err
+			}
+			data.Reset()
+			data.Write(header)
+		}
+	}
+
+	b.skip = data.Len()
+	data.Write(buf)
+
+	name := fmt.Sprintf("%s_%s_%d%s", l.spillPrefix, b.created.UTC().Format("20060102T150405.000000000Z"), b.id, ext)
+	f, err := os.OpenFile(filepath.Join(l.spillDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data.Bytes()); err != nil {
+		f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	b.path = f.Name()
+	return nil
+}
+
+// state returns the size and number of batches of the list, and the
+// creation time of the oldest batch, including the ones being sent
+func (l *bufferList) state() (int, int, time.Time) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	var oldest time.Time
+	if l.head != nil {
+		oldest = l.head.created
+	}
+
+	for _, b := range l.sending {
+		if oldest.IsZero() || b.created.Before(oldest) {
+			oldest = b.created
+		}
+	}
+
+	return l.size, l.batches, oldest
+}
+
+// add appends a write to the list, ctx holds its span and request ID
+func (l *bufferList) add(ctx context.Context, buf []byte, query string, auth string, endpoint string) (*batch, error) {
 	l.cond.L.Lock()
 
 	if l.size+len(buf) > l.maxSize {
@@ -207,7 +1075,7 @@ func (l *bufferList) add(buf []byte, query string, auth string, endpoint string)
 	}
 
 	l.size += len(buf)
-	l.cond.Signal()
+	l.cond.Broadcast()
 
 	var cur **batch
 
@@ -231,6 +1099,10 @@ func (l *bufferList) add(buf []byte, query string, auth string, endpoint string)
 	if *cur == nil {
 		// new tail element
 		*cur = newBatch(buf, query, auth, endpoint)
+		(*cur).compressed = l.compress
+		l.lastID++
+		(*cur).id = l.lastID
+		l.batches++
 	} else {
 		// append to current batch
 		b := *cur
@@ -238,6 +1110,146 @@ func (l *bufferList) add(buf []byte, query string, auth string, endpoint string)
 		b.bufs = append(b.bufs, buf)
 	}
 
+	l.track(ctx, *cur)
+
 	defer l.cond.L.Unlock()
 	return *cur, nil
 }
+
+// track records the span and request ID held by ctx in a batch
+func (l *bufferList) track(ctx context.Context, b *batch) {
+	if span := trace.FromContext(ctx); span != nil && span.SpanContext().IsSampled() {
+		b.spans = append(b.spans, span.SpanContext())
+	}
+
+	if id := logging.RequestID(ctx); id != "" {
+		b.requestIDs = append(b.requestIDs, id)
+	}
+}
+
+// batchInfo describes a buffered batch
+type batchInfo struct {
+	ID              uint64 `json:"id"`
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retentionPolicy,omitempty"`
+	Precision       string `json:"precision,omitempty"`
+	Endpoint        string `json:"endpoint"`
+	Size            int    `json:"size"`
+	Writes          int    `json:"writes"`
+	AgeMs           int64  `json:"ageMs"`
+	Attempts        int64  `json:"attempts"`
+	Sending         bool   `json:"sending"`
+	Spilled         bool   `json:"spilled,omitempty"`
+}
+
+func (b *batch) info(now time.Time) batchInfo {
+	params, _ := url.ParseQuery(b.query)
+
+	writes := len(b.bufs)
+	if b.path != "" {
+		writes = 1
+	}
+
+	return batchInfo{
+		ID:              b.id,
+		Database:        params.Get("db"),
+		RetentionPolicy: params.Get("rp"),
+		Precision:       params.Get("precision"),
+		Endpoint:        b.endpoint,
+		Size:            b.size,
+		Writes:          writes,
+		AgeMs:           now.Sub(b.created).Milliseconds(),
+		Attempts:        atomic.LoadInt64(&b.attempts),
+		Spilled:         b.path != "",
+	}
+}
+
+// infos describes the batches of the list, the ones being sent coming first
+func (l *bufferList) infos() []batchInfo {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	now := time.Now()
+	res := []batchInfo{}
+	for _, b := range l.sending {
+		if atomic.LoadInt32(&b.deleted) == 0 {
+			info := b.info(now)
+			info.Sending = true
+			res = append(res, info)
+		}
+	}
+
+	for b := l.head; b != nil; b = b.next {
+		res = append(res, b.info(now))
+	}
+
+	return res
+}
+
+// get returns the description and a copy of the body of a batch
+// The writes of a batch are released once it is done, they
+// must not be used outside of the lock of the list
+func (l *bufferList) get(id uint64) (batchInfo, []byte, bool) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	b := l.find(id)
+	if b == nil {
+		return batchInfo{}, nil, false
+	}
+
+	body := bytes.NewBuffer(make([]byte, 0, b.size))
+	if err := b.load(body); err != nil {
+		return batchInfo{}, nil, false
+	}
+
+	return b.info(time.Now()), body.Bytes(), true
+}
+
+func (l *bufferList) find(id uint64) *batch {
+	for _, b := range l.sending {
+		if b.id == id && atomic.LoadInt32(&b.deleted) == 0 {
+			return b
+		}
+	}
+
+	for b := l.head; b != nil; b = b.next {
+		if b.id == id {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// remove deletes a batch from the list, the batches being sent
+// are only marked as deleted and dropped by the retry loop
+func (l *bufferList) remove(id uint64) bool {
+	l.cond.L.Lock()
+
+	for _, b := range l.sending {
+		if b.id == id {
+			found := atomic.CompareAndSwapInt32(&b.deleted, 0, 1)
+			l.cond.L.Unlock()
+			return found
+		}
+	}
+
+	for cur := &l.head; *cur != nil; cur = &(*cur).next {
+		if b := *cur; b.id == id {
+			*cur = b.next
+			l.unlink(b)
+			l.cond.Broadcast()
+			l.cond.L.Unlock()
+
+			if b.path != "" {
+				_ = os.Remove(b.path)
+			}
+			b.wg.Done()
+			return true
+		}
+	}
+
+	l.cond.L.Unlock()
+	return false
+}
@@ -0,0 +1,749 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/stats/view"
+	"golang.org/x/time/rate"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/metric"
+)
+
+// mockPoster is a poster whose answers are controlled by the tests
+type mockPoster struct {
+	mu     sync.Mutex
+	err    error
+	status int
+	posted [][]byte
+}
+
+func (m *mockPoster) post(_ context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.posted = append(m.posted, append([]byte(nil), buf...))
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	return &responseData{StatusCode: m.status}, nil
+}
+
+func (m *mockPoster) set(status int, err error) {
+	m.mu.Lock()
+	m.status, m.err = status, err
+	m.mu.Unlock()
+}
+
+func (m *mockPoster) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.posted)
+}
+
+func viewValue(t *testing.T, name string, backend string) float64 {
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metric.KeyBackend && tg.Value == backend {
+				switch d := r.Data.(type) {
+				case *view.LastValueData:
+					return d.Value
+				case *view.SumData:
+					return d.Value
+				case *view.CountData:
+					return float64(d.Value)
+				}
+			}
+		}
+	}
+
+	return -1
+}
+
+// waitFor polls cond until it holds, unlike assert.Eventually
+// the condition is never called once waitFor returned
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition never satisfied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// metricsRuns tells apart the runs of TestRetryBufferMetrics, the
+// views keeping the values recorded by the previous ones
+var metricsRuns int64
+
+func TestRetryBufferMetrics(t *testing.T) {
+	backend := fmt.Sprintf("metrics-backend-%d", atomic.AddInt64(&metricsRuns, 1))
+	p := &mockPoster{err: errors.New("down")}
+	r := newRetryBuffer("relay", backend, 10, 10, time.Millisecond, p)
+
+	go func() { _, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "write") }()
+
+	waitFor(t, func() bool {
+		return viewValue(t, "relay/buffer/batches", backend) == 0 && p.count() > 1
+	})
+
+	// Too large to fit in the buffer
+	_, err := r.post(context.Background(), []byte("cpu value=1\n"), "db=test", "", "write")
+	assert.Equal(t, ErrBufferFull, err)
+	assert.Equal(t, float64(1), viewValue(t, "relay/buffer/dropped_count", backend))
+	assert.Equal(t, float64(12), viewValue(t, "relay/buffer/dropped_bytes", backend))
+	assert.True(t, viewValue(t, "relay/buffer/oldest_age_seconds", backend) > 0)
+
+	p.set(204, nil)
+	waitFor(t, func() bool {
+		return viewValue(t, "relay/buffer/oldest_age_seconds", backend) == 0
+	})
+}
+
+func TestRetryBufferFirstDelay(t *testing.T) {
+	var mu sync.Mutex
+	var sent []time.Time
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sent = append(sent, time.Now())
+		if len(sent) < 3 {
+			return nil, errors.New("down")
+		}
+		return &responseData{StatusCode: 204}, nil
+	})
+
+	r := newRetryBuffer("relay", "delayed-backend", 1024, 1024, time.Minute, p)
+	r.initialInterval = 100 * time.Millisecond
+	r.multiplier = 4
+
+	// The direct post and the first attempt fail, the second attempt
+	// waits for the jittered initial interval rather than a multiple
+	resp, err := r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "/write")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, sent, 3) {
+		delay := sent[2].Sub(sent[1])
+		assert.True(t, delay >= 50*time.Millisecond && delay < 200*time.Millisecond, delay)
+	}
+}
+
+func TestRetryBufferPause(t *testing.T) {
+	p := &mockPoster{status: 204}
+	r := newRetryBuffer("relay", "paused-backend", 1024, 1024, time.Hour, p)
+
+	r.pause()
+	go func() { _, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "write") }()
+
+	waitFor(t, func() bool {
+		_, _, oldest := r.list.state()
+		return !oldest.IsZero()
+	})
+	assert.Equal(t, 0, p.count())
+
+	// Retrying a paused backend sends nothing
+	r.retryNow()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, p.count())
+
+	r.resume()
+	waitFor(t, func() bool {
+		return p.count() == 1
+	})
+}
+
+func TestRetryBufferRetryNow(t *testing.T) {
+	p := &mockPoster{err: errors.New("down")}
+	r := newRetryBuffer("relay", "retried-backend", 1024, 1024, time.Hour, p)
+	r.initialInterval = time.Hour
+
+	go func() { _, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "write") }()
+
+	// The direct post and the first attempt fail, the next one is in an hour
+	waitFor(t, func() bool {
+		return p.count() == 2
+	})
+
+	p.set(204, nil)
+	r.retryNow()
+	waitFor(t, func() bool {
+		_, _, oldest := r.list.state()
+		return p.count() == 3 && oldest.IsZero()
+	})
+}
+
+func TestBufferListRemove(t *testing.T) {
+	l := newBufferList(1024, 16)
+	ctx := context.Background()
+
+	_, _ = l.add(ctx, []byte("cpu v=1\n"), "db=a", "", "/write")
+	_, _ = l.add(ctx, []byte("cpu v=2\n"), "db=b&rp=weekly", "", "/write")
+	_, _ = l.add(ctx, []byte("cpu v=3\n"), "db=b&rp=weekly", "", "/write")
+
+	infos := l.infos()
+	if assert.Len(t, infos, 2) {
+		assert.Equal(t, uint64(1), infos[0].ID)
+		assert.Equal(t, "a", infos[0].Database)
+		assert.Equal(t, "weekly", infos[1].RetentionPolicy)
+		assert.Equal(t, 2, infos[1].Writes)
+	}
+
+	_, body, ok := l.get(2)
+	assert.True(t, ok)
+	assert.Equal(t, "cpu v=2\ncpu v=3\n", string(body))
+
+	// The batch being sent is only marked as deleted
+	sending := l.pop()
+	assert.True(t, l.remove(1))
+	assert.Equal(t, int32(1), sending.deleted)
+	assert.False(t, l.remove(1))
+
+	assert.True(t, l.remove(2))
+	size, batches, _ := l.state()
+	assert.Equal(t, 0, size)
+	assert.Equal(t, 0, batches)
+
+	_, _, ok = l.get(2)
+	assert.False(t, ok)
+}
+
+// rejectingPoster answers with a 500 to the writes holding a bad point
+type rejectingPoster struct {
+	mu       sync.Mutex
+	accepted []string
+}
+
+func (p *rejectingPoster) post(_ context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if bytes.Contains(buf, []byte("bad")) {
+		return &responseData{StatusCode: 500, Body: []byte(`{"error":"engine panic"}`)}, nil
+	}
+
+	p.accepted = append(p.accepted, string(buf))
+	return &responseData{StatusCode: 204}, nil
+}
+
+func (p *rejectingPoster) lines() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return strings.Split(strings.TrimSpace(strings.Join(p.accepted, "")), "\n")
+}
+
+func TestRetryBufferMaxAttempts(t *testing.T) {
+	p := &mockPoster{status: 500}
+	r := newRetryBuffer("relay", "poisoned-backend", 1024, 1024, time.Millisecond, p)
+	r.initialInterval = time.Millisecond
+	r.maxAttempts = 3
+	d := &memoryDeadLetter{maxSize: MB}
+	r.deadLetter = d
+
+	_, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test&rp=weekly", "", "/write")
+
+	entries := d.list()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, int64(3), entries[0].Attempts)
+		assert.Equal(t, "test", entries[0].Database)
+		assert.Equal(t, "weekly", entries[0].RetentionPolicy)
+		assert.Equal(t, "cpu v=1\n", string(entries[0].body))
+		assert.Equal(t, "500 response: ", entries[0].Error)
+	}
+
+	// The next batches are sent
+	p.set(204, nil)
+	_, _ = r.post(context.Background(), []byte("cpu v=2\n"), "db=test", "", "/write")
+	assert.Equal(t, 5, p.count())
+}
+
+func TestRetryBufferSplit(t *testing.T) {
+	p := &rejectingPoster{}
+	r := newRetryBuffer("relay", "split-backend", 1024, 1024, time.Millisecond, p)
+	r.maxAttempts = 1
+	r.split = true
+	d := &memoryDeadLetter{maxSize: MB}
+	r.deadLetter = d
+
+	_, _ = r.post(context.Background(), []byte("a v=1\nbad v=2\nc v=3\nd v=4\ne v=5\n"), "db=test", "", "/write")
+
+	waitFor(t, func() bool {
+		return len(p.lines()) == 4
+	})
+	assert.Equal(t, []string{"a v=1", "c v=3", "d v=4", "e v=5"}, p.lines())
+
+	entries := d.list()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "bad v=2\n", string(entries[0].body))
+		assert.Equal(t, `500 response: {"error":"engine panic"}`, entries[0].Error)
+	}
+}
+
+func TestRetryBufferSplitCompressed(t *testing.T) {
+	p := &rejectingPoster{}
+	r := newRetryBuffer("relay", "split-backend", 1024, 1024, time.Millisecond, p)
+	r.list.compress = true
+	r.maxAttempts = 1
+	r.split = true
+	d := &memoryDeadLetter{maxSize: MB}
+	r.deadLetter = d
+
+	_, _ = r.post(context.Background(), []byte("a v=1\nbad v=2\nc v=3\nd v=4\ne v=5\n"), "db=test", "", "/write")
+
+	waitFor(t, func() bool {
+		return len(p.lines()) == 4 && len(d.list()) == 1
+	})
+	assert.Equal(t, []string{"a v=1", "c v=3", "d v=4", "e v=5"}, p.lines())
+	assert.Equal(t, "bad v=2\n", string(d.list()[0].body))
+
+	// The halves were held compressed, and accounted for in the buffer
+	waitFor(t, func() bool { return r.list.drained() })
+	size, _, _ := r.list.state()
+	assert.Equal(t, 0, size)
+}
+
+func TestRetryBufferSplitUnavailable(t *testing.T) {
+	// A proxy in front of a backend which is down does not blame the batch
+	p := &mockPoster{status: http.StatusBadGateway}
+	r := newRetryBuffer("relay", "split-backend", 1024, 1024, time.Millisecond, p)
+	r.maxAttempts = 1
+	r.split = true
+	d := &memoryDeadLetter{maxSize: MB}
+	r.deadLetter = d
+
+	_, _ = r.post(context.Background(), []byte("a v=1\nb v=2\n"), "db=test", "", "/write")
+
+	entries := d.list()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "a v=1\nb v=2\n", string(entries[0].body))
+	}
+
+	// The write was tried once, then once from the buffer
+	assert.Equal(t, 2, p.count())
+}
+
+func TestRetryBufferSplitFull(t *testing.T) {
+	p := &rejectingPoster{}
+	r := newRetryBuffer("relay", "split-backend", 20, 1024, time.Millisecond, p)
+	r.maxAttempts = 1
+	r.split = true
+	d := &memoryDeadLetter{maxSize: MB}
+	r.deadLetter = d
+	r.pause()
+
+	// The halves of the batch being sent do not fit along the queued write
+	go func() { _, _ = r.post(context.Background(), []byte("a v=1\nbad v=2\n"), "db=test", "", "/write") }()
+	waitFor(t, func() bool {
+		infos := r.list.infos()
+		return len(infos) == 1 && infos[0].Sending
+	})
+	go func() { _, _ = r.post(context.Background(), []byte("ok v=1\n"), "db=other", "", "/write") }()
+	waitFor(t, func() bool { return len(r.list.infos()) == 2 })
+
+	r.resume()
+	waitFor(t, func() bool { return r.list.drained() })
+
+	entries := d.list()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "a v=1\nbad v=2\n", string(entries[0].body))
+	}
+	assert.Equal(t, []string{"ok v=1"}, p.lines())
+}
+
+// posterFunc is a poster answering with a function
+type posterFunc func(buf []byte) (*responseData, error)
+
+func (f posterFunc) post(_ context.Context, buf []byte, query string, auth string, endpoint string) (*responseData, error) {
+	return f(buf)
+}
+
+// bufferingWhenSent returns whether the buffer was still buffering
+// when each of three buffered batches was sent
+func bufferingWhenSent(t *testing.T, drain bool) []int32 {
+	var mu sync.Mutex
+	var r *retryBuffer
+	var buffering []int32
+
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		mu.Lock()
+		buffering = append(buffering, atomic.LoadInt32(&r.buffering))
+		mu.Unlock()
+		return &responseData{StatusCode: 204}, nil
+	})
+
+	r = newRetryBuffer("relay", "drained-backend", 1024, 8, time.Millisecond, p)
+	r.drain = drain
+	r.pause()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "/write")
+		}()
+	}
+
+	waitFor(t, func() bool {
+		size, _, _ := r.list.state()
+		return size == 16
+	})
+
+	r.resume()
+	wg.Wait()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&r.buffering))
+
+	mu.Lock()
+	defer mu.Unlock()
+	return buffering
+}
+
+func TestRetryBufferDrain(t *testing.T) {
+	assert.Equal(t, []int32{1, 0, 0}, bufferingWhenSent(t, false))
+	assert.Equal(t, []int32{1, 1, 1}, bufferingWhenSent(t, true))
+}
+
+func TestRetryBufferDrainRate(t *testing.T) {
+	sent := make(chan struct{}, 3)
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		sent <- struct{}{}
+		return &responseData{StatusCode: 204}, nil
+	})
+
+	r := newRetryBuffer("relay", "throttled-backend", 1024, 8, time.Millisecond, p)
+	r.limiter = rate.NewLimiter(100, 8)
+	r.pause()
+
+	for i := 0; i < 3; i++ {
+		go func() { _, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "/write") }()
+	}
+
+	waitFor(t, func() bool {
+		size, _, _ := r.list.state()
+		return size == 16
+	})
+
+	// The first batch uses the burst, the next ones wait 80ms each
+	start := time.Now()
+	r.resume()
+	for i := 0; i < 3; i++ {
+		<-sent
+	}
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, time.Since(start))
+}
+
+func TestBufferListPopDatabase(t *testing.T) {
+	l := newBufferList(1024, 8)
+	ctx := context.Background()
+
+	_, _ = l.add(ctx, []byte("cpu v=1\n"), "db=a", "", "/write")
+	_, _ = l.add(ctx, []byte("cpu v=2\n"), "db=a", "", "/write")
+	_, _ = l.add(ctx, []byte("cpu v=3\n"), "db=b", "", "/write")
+
+	// The second batch of a waits for the first one
+	first := l.pop()
+	assert.Equal(t, uint64(1), first.id)
+	assert.Equal(t, uint64(3), l.pop().id)
+
+	popped := make(chan *batch)
+	go func() { popped <- l.pop() }()
+
+	select {
+	case b := <-popped:
+		t.Fatalf("batch %d popped while its database is being sent", b.id)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.done(first)
+	assert.Equal(t, uint64(2), (<-popped).id)
+}
+
+func TestRetryBufferWorkers(t *testing.T) {
+	var mu sync.Mutex
+	sending := map[string]int{}
+	peak := 0
+	release := make(chan struct{})
+
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		db := string(buf[:1])
+
+		mu.Lock()
+		sending[db]++
+		if sending[db] > 1 {
+			t.Errorf("%d batches of %s sent at once", sending[db], db)
+		}
+		if n := len(sending); n > peak {
+			peak = n
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		if sending[db]--; sending[db] == 0 {
+			delete(sending, db)
+		}
+		mu.Unlock()
+		return &responseData{StatusCode: 204}, nil
+	})
+
+	r := newRetryBuffer("relay", "parallel-backend", 1024, 8, time.Millisecond, p)
+	r.start(2)
+	r.pause()
+
+	var wg sync.WaitGroup
+	for _, write := range []string{"a v=1\n", "a v=2\n", "b v=1\n", "c v=1\n"} {
+		wg.Add(1)
+		go func(write string) {
+			defer wg.Done()
+			_, _ = r.post(context.Background(), []byte(write), "db="+write[:1], "", "/write")
+		}(write)
+	}
+
+	waitFor(t, func() bool {
+		return len(r.list.infos()) == 4
+	})
+
+	// The three workers send a batch of each database, the second batch of a waits
+	r.resume()
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sending) == 3
+	})
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 3, peak)
+	assert.True(t, r.list.drained())
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d >= 500*time.Millisecond && d <= time.Second, d)
+	}
+
+	assert.Equal(t, time.Duration(0), jitter(0))
+}
+
+// overflowed fills a paused buffer with two writes before posting a third one,
+// it returns the response to each write once the buffer is resumed
+func overflowed(t *testing.T, r *retryBuffer) ([]*responseData, []error) {
+	var mu sync.Mutex
+	resps := make([]*responseData, 3)
+	errs := make([]error, 3)
+	answered := 0
+
+	r.pause()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := r.post(context.Background(), []byte(fmt.Sprintf("cpu v=%d\n", i)), "db=test", "", "/write")
+
+			mu.Lock()
+			resps[i], errs[i] = resp, err
+			answered++
+			mu.Unlock()
+		}(i)
+
+		// The third write is buffered, blocked or dropped
+		waitFor(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(r.list.infos()) == i+1 || answered > 0
+		})
+	}
+
+	r.resume()
+	wg.Wait()
+
+	return resps, errs
+}
+
+func overflowBuffer(policy string, p poster) *retryBuffer {
+	// The first batch is popped by the worker, the second one fills the buffer
+	r := newRetryBuffer("relay", "overflow-backend", 8, 8, time.Millisecond, p)
+	r.overflow = policy
+	r.overflowTimeout = time.Second
+	return r
+}
+
+func TestRetryBufferOverflowDropNewest(t *testing.T) {
+	resps, errs := overflowed(t, overflowBuffer(config.OverflowDropNewest, &mockPoster{status: 204}))
+
+	assert.Equal(t, []error{nil, nil, ErrBufferFull}, errs)
+	assert.Equal(t, http.StatusAccepted, resps[1].StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, resps[2].StatusCode)
+}
+
+func TestRetryBufferOverflowDropOldest(t *testing.T) {
+	resps, errs := overflowed(t, overflowBuffer(config.OverflowDropOldest, &mockPoster{status: 204}))
+
+	// The batch being sent is not evicted
+	assert.Equal(t, []error{nil, ErrBufferDropped, nil}, errs)
+	assert.Equal(t, http.StatusServiceUnavailable, resps[1].StatusCode)
+	assert.Equal(t, http.StatusAccepted, resps[2].StatusCode)
+}
+
+func TestRetryBufferOverflowBlock(t *testing.T) {
+	r := overflowBuffer(config.OverflowBlock, &mockPoster{status: 204})
+	r.overflowTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	_, errs := overflowed(t, r)
+	assert.Equal(t, []error{nil, nil, ErrBufferFull}, errs)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// Room is made once the backend is resumed
+	r = overflowBuffer(config.OverflowBlock, &mockPoster{status: 204})
+	r.pause()
+	for i := 0; i < 2; i++ {
+		go func() { _, _ = r.post(context.Background(), []byte("cpu v=1\n"), "db=test", "", "/write") }()
+	}
+	waitFor(t, func() bool {
+		return len(r.list.infos()) == 2
+	})
+
+	time.AfterFunc(10*time.Millisecond, r.resume)
+	resp, err := r.post(context.Background(), []byte("cpu v=2\n"), "db=test", "", "/write")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func TestRetryBufferOverflowSpill(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spill")
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var sent []string
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		mu.Lock()
+		sent = append(sent, string(buf))
+		mu.Unlock()
+		return &responseData{StatusCode: 204}, nil
+	})
+
+	r := overflowBuffer(config.OverflowSpill, p)
+	r.list.spillDir = dir
+	r.list.spillPrefix = "relay_overflow-backend"
+	r.list.maxSpill = 1024
+
+	resps, errs := overflowed(t, r)
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, http.StatusAccepted, resps[2].StatusCode)
+	assert.Equal(t, []string{"cpu v=0\n", "cpu v=1\n", "cpu v=2\n"}, sent)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, files)
+	assert.Equal(t, 0, r.list.spilledSize())
+}
+
+func TestRetryBufferSpillFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spill")
+	defer os.RemoveAll(dir)
+
+	// The ids of the batches restart with the relay, the files left
+	// by a previous run are not overwritten
+	for _, compress := range []bool{false, true} {
+		r := newRetryBuffer("relay", "spill-backend", 1024, 1024, time.Millisecond, &mockPoster{status: 204})
+		r.list.compress = compress
+		r.pause()
+		r.list.spillDir = dir
+		r.list.spillPrefix = "relay_spill-backend"
+		r.list.maxSpill = 1024
+
+		buf, err := r.list.encode([]byte("cpu v=1 1\n"))
+		assert.NoError(t, err)
+		b, err := r.list.spill(context.Background(), buf, "db=test&rp=weekly&precision=s", "", "/write")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), b.id)
+
+		var body bytes.Buffer
+		assert.NoError(t, b.load(&body))
+		assert.Equal(t, "cpu v=1 1\n", body.String())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "relay_spill-backend_*"))
+	assert.Len(t, files, 2)
+
+	// The files hold the context of the write, like the dead letter files
+	for _, file := range files {
+		in, c, err := openReplayFile(file)
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(in)
+		c.Close()
+
+		assert.Equal(t, "# precision: s\n# DML\n# CONTEXT-DATABASE: test\n# CONTEXT-RETENTION-POLICY: weekly\ncpu v=1 1\n", string(data))
+	}
+}
+
+func TestRetryBufferCompression(t *testing.T) {
+	sent := make(chan string, 2)
+	p := posterFunc(func(buf []byte) (*responseData, error) {
+		sent <- string(buf)
+		return &responseData{StatusCode: 204}, nil
+	})
+
+	r := newRetryBuffer("relay", "compressed-backend", 1024, 1024, time.Millisecond, p)
+	r.list.compress = true
+	r.pause()
+
+	// The writes are posted one at a time, the first one being held by the
+	// paused worker while the second one waits in the list
+	write := strings.Repeat("cpu,host=server01 value=1\n", 100)
+	for i := 1; i <= 2; i++ {
+		go func() { _, _ = r.post(context.Background(), []byte(write), "db=test", "", "/write") }()
+
+		i := i
+		waitFor(t, func() bool {
+			infos := r.list.infos()
+			return len(infos) == i && infos[0].Sending
+		})
+	}
+
+	// The queued write is held in much less than its size
+	size, _, _ := r.list.state()
+	assert.True(t, size < len(write)/4, size)
+
+	queued := r.list.infos()[1]
+	assert.False(t, queued.Sending)
+
+	_, body, ok := r.list.get(queued.ID)
+	assert.True(t, ok)
+	assert.Equal(t, write, string(body))
+
+	r.resume()
+	assert.Equal(t, write, <-sent)
+	assert.Equal(t, write, <-sent)
+}
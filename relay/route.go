@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"regexp"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// Route lists the outputs of a relay a point would be forwarded to
+type Route struct {
+	Kind    string
+	Relay   string
+	Outputs []string
+}
+
+type routeOutput struct {
+	name               string
+	tagRegexps         []*regexp.Regexp
+	measurementRegexps []*regexp.Regexp
+}
+
+type routeRelay struct {
+	kind    string
+	name    string
+	outputs []routeOutput
+}
+
+// Router computes where points would be sent by the relays
+// of a configuration, without creating any of them
+type Router struct {
+	relays []routeRelay
+}
+
+// NewRouter creates a Router from the configuration
+// The filters regular expressions have to be loaded
+func NewRouter(cfg config.Config) *Router {
+	r := new(Router)
+
+	for _, h := range cfg.HTTPRelays {
+		rr := routeRelay{kind: "http", name: h.RelayName()}
+		for _, o := range h.Outputs {
+			name := o.Name
+			if name == "" {
+				name = o.Location
+			}
+
+			tags, measurements := filterRegexps(name, cfg.Filters)
+			rr.outputs = append(rr.outputs, routeOutput{name, tags, measurements})
+		}
+		r.relays = append(r.relays, rr)
+	}
+
+	// UDP relays do not apply any filter
+	for _, u := range cfg.UDPRelays {
+		rr := routeRelay{kind: "udp", name: u.RelayName()}
+		for _, o := range u.Outputs {
+			name := o.Name
+			if name == "" {
+				name = o.Location
+			}
+
+			rr.outputs = append(rr.outputs, routeOutput{name: name})
+		}
+		r.relays = append(r.relays, rr)
+	}
+
+	return r
+}
+
+// Route returns, for each relay, the outputs the point would be forwarded to
+func (r *Router) Route(p models.Point) []Route {
+	routes := make([]Route, 0, len(r.relays))
+
+	for _, rr := range r.relays {
+		route := Route{Kind: rr.kind, Relay: rr.name}
+		for _, o := range rr.outputs {
+			if matchRegexps(p, o.tagRegexps, o.measurementRegexps) == nil {
+				route.Outputs = append(route.Outputs, o.name)
+			}
+		}
+		routes = append(routes, route)
+	}
+
+	return routes
+}
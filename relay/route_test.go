@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func TestRouter(t *testing.T) {
+	cfg := config.Config{
+		HTTPRelays: []config.HTTPConfig{{
+			Addr: "127.0.0.1:9096",
+			Outputs: []config.HTTPOutputConfig{
+				{Name: "all"},
+				{Name: "short"},
+			},
+		}},
+		UDPRelays: []config.UDPConfig{{
+			Name:    "udp",
+			Outputs: []config.UDPOutputConfig{{Location: "127.0.0.1:8089"}},
+		}},
+		Filters: config.Filters{{
+			MeasurementExpression: "^.{0,3}$",
+			Outputs:               []string{"short"},
+		}},
+	}
+	assert.NoError(t, cfg.Filters.LoadRegexps())
+
+	router := NewRouter(cfg)
+	points, err := models.ParsePointsString("cpu value=1\nmemory value=2")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Route{
+		{Kind: "http", Relay: "http://127.0.0.1:9096", Outputs: []string{"all", "short"}},
+		{Kind: "udp", Relay: "udp", Outputs: []string{"127.0.0.1:8089"}},
+	}, router.Route(points[0]))
+
+	assert.Equal(t, []Route{
+		{Kind: "http", Relay: "http://127.0.0.1:9096", Outputs: []string{"all"}},
+		{Kind: "udp", Relay: "udp", Outputs: []string{"127.0.0.1:8089"}},
+	}, router.Route(points[1]))
+
+}
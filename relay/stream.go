@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// streamWrite forwards a write larger than the stream threshold by chunks of
+// points, a chunk being read once the backends answered or buffered the
+// previous one so that the whole body is never held, the chunks held by the
+// retry buffers being bounded by their size. head is the start of the body,
+// already read. The chunks sent before a failure stay written.
+func (h *HTTP) streamWrite(w http.ResponseWriter, r *http.Request, start time.Time, head *bytes.Buffer) {
+	defer putBuf(head)
+
+	body := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(head.Bytes()), r.Body), 64*KB)
+
+	var resp *responseData
+	var err error
+	points, chunks := 0, 0
+	defer func() {
+		accessEntryFrom(r.Context()).setPoints(points)
+	}()
+
+	for eof := false; !eof; {
+		chunk := getBuf()
+		if eof, err = readChunk(body, chunk, h.streamChunk); err != nil {
+			putBuf(chunk)
+			h.bodyError(w, r, err)
+			return
+		}
+
+		if chunk.Len() == 0 {
+			putBuf(chunk)
+			break
+		}
+
+		var n int
+		var done <-chan struct{}
+		resp, n, done, err = h.forwardWrite(r, start, chunk)
+		points += n
+		chunks++
+		if err != nil || resp == nil || resp.StatusCode/100 == 4 {
+			break
+		}
+
+		// Bound the memory held by the write to one chunk, apart from the
+		// chunks held by the retry buffers
+		<-done
+	}
+
+	h.requestLogger(r).Debug("write streamed", "chunks", chunks, "points", points)
+	h.writeResponse(w, r, resp, err)
+}
+
+// readChunk reads the next lines lines of a body into buf, and tells whether
+// the body is over
+func readChunk(body *bufio.Reader, buf *bytes.Buffer, lines int) (bool, error) {
+	for lines > 0 {
+		line, err := body.ReadSlice('\n')
+		_, _ = buf.Write(line)
+
+		switch err {
+		case nil:
+			lines--
+		case bufio.ErrBufferFull:
+			// The line goes on
+		case io.EOF:
+			return true, nil
+		default:
+			return false, err
+		}
+	}
+
+	return false, nil
+}
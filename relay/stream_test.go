@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+func TestMaxBodySize(t *testing.T) {
+	h := createHTTP(t, config.HTTPConfig{
+		Outputs: []config.HTTPOutputConfig{{Name: "influx", Location: ValidServer.URL}},
+	}, false)
+	h.maxBodySize = 16
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte("cpu value=1 1\ncpu value=2 2\n"))
+	_ = zw.Close()
+
+	for _, tc := range []struct {
+		name     string
+		request  func() *http.Request
+		expected int
+	}{
+		{"below the limit", func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/write?db=test", strings.NewReader("cpu value=1 1\n"))
+		}, http.StatusNoContent},
+		{"content length", func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, "/write?db=test", strings.NewReader("cpu value=1 1\ncpu value=2 2\n"))
+		}, http.StatusRequestEntityTooLarge},
+		{"chunked", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/write?db=test", strings.NewReader("cpu value=1 1\ncpu value=2 2\n"))
+			r.ContentLength = -1
+			return r
+		}, http.StatusRequestEntityTooLarge},
+		{"gzip", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/write?db=test", bytes.NewReader(gz.Bytes()))
+			r.Header.Set("Content-Encoding", "gzip")
+			return r
+		}, http.StatusRequestEntityTooLarge},
+		{"prometheus", func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/prom/write?db=test", strings.NewReader("a snappy remote write"))
+			r.ContentLength = -1
+			return r
+		}, http.StatusRequestEntityTooLarge},
+	} {
+		r := tc.request()
+		rec := httptest.NewRecorder()
+		handler := h.bodyMiddleWare((*HTTP).handleStandard)
+		if strings.HasPrefix(r.URL.Path, "/api") {
+			handler = h.bodyMiddleWare((*HTTP).handleProm)
+		}
+		handler(h, rec, r, time.Now())
+		assert.Equal(t, tc.expected, rec.Code, tc.name)
+	}
+}
+
+func TestStreamWrite(t *testing.T) {
+	received := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Outputs: []config.HTTPOutputConfig{{Name: "influx", Location: backend.URL}},
+	}, false)
+	h.streamThreshold = 16
+	h.streamChunk = 2
+
+	var body bytes.Buffer
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&body, "cpu value=%d %d\n", i, i)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/write?db=test", &body)
+	rec := httptest.NewRecorder()
+	h.handleStandard(rec, r, time.Now())
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, int64(5), h.counters.points)
+
+	assert.Equal(t, "cpu value=1 1\ncpu value=2 2\n", <-received)
+	assert.Equal(t, "cpu value=3 3\ncpu value=4 4\n", <-received)
+	assert.Equal(t, "cpu value=5 5\n", <-received)
+
+	// A chunk which does not parse ends the write, the previous ones being written
+	r = httptest.NewRequest(http.MethodPost, "/write?db=test", strings.NewReader("cpu value=1 1\ncpu value=2 2\nnot a point\n"))
+	rec = httptest.NewRecorder()
+	h.handleStandard(rec, r, time.Now())
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "cpu value=1 1\ncpu value=2 2\n", <-received)
+	assert.Len(t, received, 0)
+}
+
+func TestStreamWriteBuffered(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	h := createHTTP(t, config.HTTPConfig{
+		Outputs: []config.HTTPOutputConfig{
+			{Name: "up", Location: up.URL},
+			{Name: "buffered", Location: down.URL, BufferSizeMB: 1, MaxDelayInterval: "1h"},
+		},
+	}, false)
+	h.streamThreshold = 16
+	h.streamChunk = 1
+
+	// The chunks buffered for the output which is down are not waited for
+	handled := make(chan int, 1)
+	go func() {
+		r := httptest.NewRequest(http.MethodPost, "/write?db=test", strings.NewReader("cpu value=1 1\ncpu value=2 2\ncpu value=3 3\n"))
+		rec := httptest.NewRecorder()
+		h.handleStandard(rec, r, time.Now())
+		handled <- rec.Code
+	}()
+
+	select {
+	case code := <-handled:
+		assert.Equal(t, http.StatusNoContent, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("streamed write waiting for the retry buffer")
+	}
+
+	// Each chunk is held by the retry buffer until sent
+	writes := 0
+	for _, info := range h.backends[1].getRetryBuffer().list.infos() {
+		writes += info.Writes
+	}
+	assert.Equal(t, 3, writes)
+}
+
+func TestReadChunk(t *testing.T) {
+	long := strings.Repeat("x", 32)
+	body := bufio.NewReaderSize(strings.NewReader("a\n"+long+"\nb\nc"), 16)
+
+	var buf bytes.Buffer
+	eof, err := readChunk(body, &buf, 2)
+	assert.NoError(t, err)
+	assert.False(t, eof)
+	assert.Equal(t, "a\n"+long+"\n", buf.String())
+
+	// The last line may not end with a newline
+	buf.Reset()
+	eof, err = readChunk(body, &buf, 2)
+	assert.NoError(t, err)
+	assert.True(t, eof)
+	assert.Equal(t, "b\nc", buf.String())
+}
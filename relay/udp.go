@@ -3,7 +3,7 @@ package relay
 import (
 	"bytes"
 	"errors"
-	"log"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -12,10 +12,12 @@ import (
 	"github.com/influxdata/influxdb/models"
 
 	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+	"github.com/strike-team/influxdb-relay/metric"
 )
 
 const (
-	defaultMTU = 1024
+	defaultMTU = config.DefaultUDPMTU
 )
 
 // UDP is a relay for UDP influxdb writes
@@ -28,7 +30,11 @@ type UDP struct {
 	l       *net.UDPConn
 	c       *net.UDPConn
 
+	counters relayCounters
+
 	backends []*udpBackend
+
+	logger *logging.Logger
 }
 
 // NewUDP -TODO-
@@ -39,6 +45,12 @@ func NewUDP(config config.UDPConfig) (Relay, error) {
 	u.addr = config.Addr
 	u.precision = config.Precision
 
+	logger, err := relayLogger(config.LogLevel, false)
+	if err != nil {
+		return nil, fmt.Errorf("relay %q: %v", u.Name(), err)
+	}
+	u.logger = logger.With("relay", u.Name())
+
 	l, err := net.ListenPacket("udp", u.addr)
 	if err != nil {
 		return nil, err
@@ -79,7 +91,7 @@ func NewUDP(config config.UDPConfig) (Relay, error) {
 			return nil, err
 		}
 
-		u.backends = append(u.backends, &udpBackend{u, cfg.Name, addr, cfg.MTU})
+		u.backends = append(u.backends, &udpBackend{u: u, name: cfg.Name, addr: addr, mtu: cfg.MTU})
 	}
 
 	return u, nil
@@ -132,13 +144,13 @@ func (u *UDP) Run() error {
 		}
 	}()
 
-	log.Printf("starting UDP relay %q on %v", u.Name(), u.l.LocalAddr())
+	u.logger.Info("starting relay", "type", "udp", "addr", u.l.LocalAddr())
 
 	for {
 		n, remote, err := u.l.ReadFromUDP(buf[:])
 		if err != nil {
 			if atomic.LoadInt64(&u.closing) == 0 {
-				log.Printf("Error reading packet in relay %q from %v: %v", u.name, remote, err)
+				u.logger.Error("error reading packet", "from", remote, "error", err)
 			} else {
 				err = nil
 			}
@@ -166,13 +178,21 @@ func (u *UDP) Stop() error {
 }
 
 func (u *UDP) post(p *packet) {
+	atomic.AddInt64(&u.counters.requests, 1)
+	atomic.AddInt64(&u.counters.writes, 1)
+
 	points, err := models.ParsePointsWithPrecision(p.data.Bytes(), p.timestamp, u.precision)
 	if err != nil {
-		log.Printf("Error parsing packet in relay %q from %v: %v", u.Name(), p.from, err)
+		atomic.AddInt64(&u.counters.parseErrors, 1)
+		metric.RecordUDPParseError(u.Name())
+		u.logger.Warn("error parsing packet", "from", p.from, "error", err)
 		putUDPBuf(p.data)
 		return
 	}
 
+	metric.RecordPointsReceived(u.Name(), "", len(points))
+	atomic.AddInt64(&u.counters.points, int64(len(points)))
+
 	out := getUDPBuf()
 	for _, pt := range points {
 		if _, err = out.WriteString(pt.PrecisionString(u.precision)); err != nil {
@@ -187,13 +207,15 @@ func (u *UDP) post(p *packet) {
 
 	if err != nil {
 		putUDPBuf(out)
-		log.Printf("Error writing points in relay %q: %v", u.Name(), err)
+		u.logger.Error("error writing points", "error", err)
 		return
 	}
 
 	for _, b := range u.backends {
-		if err := b.post(out.Bytes()); err != nil {
-			log.Printf("Error writing points in relay %q to backend %q: %v", u.Name(), b.name, err)
+		err := b.post(out.Bytes())
+		b.counters.record(out.Len(), 0, err)
+		if err != nil {
+			u.logger.Error("error writing points to backend", "backend", b.name, "error", err)
 		}
 	}
 
@@ -205,6 +227,8 @@ type udpBackend struct {
 	name string
 	addr *net.UDPAddr
 	mtu  int
+
+	counters backendCounters
 }
 
 var errPacketTooLarge = errors.New("payload larger than MTU")
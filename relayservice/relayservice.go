@@ -2,18 +2,21 @@ package relayservice
 
 import (
 	"fmt"
-	"log"
 	"sync"
 
 	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
 	"github.com/strike-team/influxdb-relay/metric"
 	"github.com/strike-team/influxdb-relay/relay"
+	"github.com/strike-team/influxdb-relay/tracing"
 )
 
 // Service is a map of relays
 type Service struct {
 	relays map[string]relay.Relay
 	ms     *metric.Server
+	mon    *relay.Monitor
+	tracer tracing.Exporter
 }
 
 // New loads the different relays from the configuration file
@@ -21,7 +24,27 @@ func New(config config.Config) (*Service, error) {
 	s := new(Service)
 	s.relays = make(map[string]relay.Relay)
 
+	// The relays and the other components log through the default logger
+	logger, err := logging.FromConfig(config.Log)
+	if err != nil {
+		return nil, err
+	}
+	if config.Verbose && config.Log.Level == "" {
+		logger = logger.WithLevel(logging.LevelDebug)
+	}
+	logging.SetDefault(logger)
+
+	metrics := config.Metrics
+
 	for _, cfg := range config.HTTPRelays {
+		// Either serve the metrics on the relay listeners
+		// or don't serve them at all
+		if !metrics.IsEnabled() {
+			cfg.MetricsPath = ""
+		} else if metrics.RelayListeners && cfg.MetricsPath == "" {
+			cfg.MetricsPath = metrics.PathOrDefault()
+		}
+
 		h, err := relay.NewHTTP(cfg, config.Verbose, config.Filters)
 		if err != nil {
 			return nil, err
@@ -43,11 +66,37 @@ func New(config config.Config) (*Service, error) {
 		s.relays[u.Name()] = u
 	}
 
-	ms, err := metric.NewServer()
+	if config.Monitor.Enabled {
+		out, ok := config.HTTPOutput(config.Monitor.Output)
+		if !ok {
+			return nil, fmt.Errorf("unknown monitor output: %q", config.Monitor.Output)
+		}
+
+		relays := make([]relay.Relay, 0, len(s.relays))
+		for _, r := range s.relays {
+			relays = append(relays, r)
+		}
+
+		mon, err := relay.NewMonitor(config.Monitor, out, relays)
+		if err != nil {
+			return nil, err
+		}
+		s.mon = mon
+	}
+
+	if metrics.IsEnabled() && !metrics.RelayListeners {
+		ms, err := metric.NewServer(metrics)
+		if err != nil {
+			return nil, err
+		}
+		s.ms = ms
+	}
+
+	tracer, err := tracing.Start(config.Tracing)
 	if err != nil {
 		return nil, err
 	}
-	s.ms = ms
+	s.tracer = tracer
 
 	return s, nil
 }
@@ -65,19 +114,32 @@ func (s *Service) Run() {
 			defer wg.Done()
 
 			if err := relay.Run(); err != nil {
-				log.Printf("Error running relay %q: %v", relay.Name(), err)
+				logging.Default().Error("error running relay", "relay", relay.Name(), "error", err)
 			}
 		}()
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	if s.ms != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-		if err := s.ms.Run(); err != nil {
-			log.Printf("Error running metric server: %v", err)
-		}
-	}()
+			if err := s.ms.Run(); err != nil {
+				logging.Default().Error("error running metric server", "error", err)
+			}
+		}()
+	}
+
+	if s.mon != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := s.mon.Run(); err != nil {
+				logging.Default().Error("error running monitor", "error", err)
+			}
+		}()
+	}
 
 	wg.Wait()
 }
@@ -88,5 +150,16 @@ func (s *Service) Stop() {
 		v.Stop()
 	}
 
-	s.ms.Stop()
+	if s.ms != nil {
+		s.ms.Stop()
+	}
+
+	if s.mon != nil {
+		s.mon.Stop()
+	}
+
+	// Send the spans still held by the exporter
+	if err := tracing.Stop(s.tracer); err != nil {
+		logging.Default().Error("error stopping trace exporter", "error", err)
+	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/relay"
+)
+
+// runReplay implements the replay subcommand which re-injects
+// line protocol files into one of the configured outputs
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: influxdb-relay replay [options] file [file...]")
+		fs.PrintDefaults()
+	}
+
+	cfgFile := fs.String("config", "", "Configuration file where the output is defined")
+	cfgFormat := fs.String("config-format", "", "Format of the configuration file (toml, yaml or json)")
+	cfgDir := fs.String("config-dir", "", "Directory of configuration fragments")
+	output := fs.String("output", "", "Name of the HTTP output to write to")
+	location := fs.String("location", "", "Location of the InfluxDB server, instead of -config/-output")
+	timeout := fs.String("timeout", "", "Timeout of each write request when using -location")
+	skipTLS := fs.Bool("skip-tls-verification", false, "Skip TLS verification when using -location")
+	db := fs.String("db", "", "Database to write the files without a # CONTEXT-DATABASE header to")
+	rp := fs.String("rp", "", "Retention policy to write the files without a # CONTEXT-RETENTION-POLICY header to")
+	precision := fs.String("precision", "", "Precision of the timestamps in the files without a # precision header (n, u, ms, s, m, h), default n")
+	username := fs.String("username", "", "Username used to authenticate against the output")
+	password := fs.String("password", "", "Password used to authenticate against the output")
+	start := fs.String("start", "", "Only replay points at or after this RFC3339 time")
+	end := fs.String("end", "", "Only replay points before this RFC3339 time")
+	pointsRate := fs.Int("rate", 0, "Maximum number of points written per second (0: unlimited)")
+	batchKB := fs.Int("batch-kb", relay.DefaultBatchSizeKB, "Maximum size of each write request in KB")
+	attempts := fs.Int("attempts", relay.DefaultReplayAttempts, "Number of tries for each batch")
+	state := fs.String("state", "", "File used to save progress and resume an interrupted replay")
+
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Missing file to replay")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var out config.HTTPOutputConfig
+	switch {
+	case *location != "":
+		out = config.HTTPOutputConfig{
+			Location:            *location,
+			Timeout:             *timeout,
+			SkipTLSVerification: *skipTLS,
+		}
+
+	case (*cfgFile != "" || *cfgDir != "") && *output != "":
+		cfg, err := config.LoadConfig(*cfgFile, *cfgFormat, *cfgDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		var ok bool
+		if out, ok = cfg.HTTPOutput(*output); !ok {
+			log.Fatalf("unknown output %q", *output)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, "Either -location or both -config and -output are required")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	opts := relay.ReplayOptions{
+		Database:        *db,
+		RetentionPolicy: *rp,
+		Precision:       *precision,
+		Rate:            *pointsRate,
+		BatchKB:         *batchKB,
+		Attempts:        *attempts,
+		StateFile:       *state,
+	}
+
+	if *username != "" {
+		opts.Auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(*username+":"+*password))
+	}
+
+	var err error
+	if *start != "" {
+		if opts.Start, err = time.Parse(time.RFC3339, *start); err != nil {
+			log.Fatalf("invalid start time: %v", err)
+		}
+	}
+
+	if *end != "" {
+		if opts.End, err = time.Parse(time.RFC3339, *end); err != nil {
+			log.Fatalf("invalid end time: %v", err)
+		}
+	}
+
+	report, err := relay.Replay(out, opts, fs.Args())
+	log.Printf("replayed %d points in %d batches (%d bytes), %d out of range, %d invalid, took %v",
+		report.Points, report.Batches, report.Bytes, report.Skipped, report.Invalid, report.Duration)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
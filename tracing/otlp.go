@@ -0,0 +1,304 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/config"
+	"github.com/strike-team/influxdb-relay/logging"
+)
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	otlpTimeout       = 10 * time.Second
+)
+
+// The types below are the JSON encoding of the OTLP trace protocol
+// https://github.com/open-telemetry/opentelemetry-proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var res []otlpAttribute
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		switch v := v.(type) {
+		case string:
+			a.Value.StringValue = &v
+		case bool:
+			a.Value.BoolValue = &v
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			a.Value.IntValue = &i
+		case float64:
+			a.Value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			a.Value.StringValue = &s
+		}
+		res = append(res, a)
+	}
+
+	return res
+}
+
+// toOTLP converts an OpenCensus span into an OTLP span
+func toOTLP(sd *trace.SpanData) otlpSpan {
+	s := otlpSpan{
+		TraceID:           sd.TraceID.String(),
+		SpanID:            sd.SpanID.String(),
+		Name:              sd.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: unixNano(sd.StartTime),
+		EndTimeUnixNano:   unixNano(sd.EndTime),
+		Attributes:        otlpAttributes(sd.Attributes),
+		Status:            otlpStatus{Code: otlpStatusUnset},
+	}
+
+	if sd.ParentSpanID != (trace.SpanID{}) {
+		s.ParentSpanID = sd.ParentSpanID.String()
+	}
+
+	switch sd.SpanKind {
+	case trace.SpanKindServer:
+		s.Kind = otlpKindServer
+	case trace.SpanKindClient:
+		s.Kind = otlpKindClient
+	}
+
+	for _, a := range sd.Annotations {
+		s.Events = append(s.Events, otlpEvent{
+			TimeUnixNano: unixNano(a.Time),
+			Name:         a.Message,
+			Attributes:   otlpAttributes(a.Attributes),
+		})
+	}
+
+	for _, l := range sd.Links {
+		s.Links = append(s.Links, otlpLink{TraceID: l.TraceID.String(), SpanID: l.SpanID.String()})
+	}
+
+	if sd.Code != trace.StatusCodeOK {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: sd.Message}
+	}
+
+	return s
+}
+
+// otlpExporter sends the spans by batches to an OTLP/HTTP collector,
+// using the JSON encoding
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+
+	mu    sync.Mutex
+	spans []otlpSpan
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newOTLPExporter(cfg config.TracingConfig) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: cfg.Endpoint,
+		headers:  cfg.Headers,
+		service:  cfg.ServiceName,
+		// The exporter must not be traced itself
+		client: &http.Client{Timeout: otlpTimeout},
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	if e.endpoint == "" {
+		e.endpoint = config.DefaultTracingEndpoint
+	}
+
+	if e.service == "" {
+		e.service = config.DefaultTracingService
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e
+}
+
+// ExportSpan queues the span, the spans are sent by a background goroutine
+func (e *otlpExporter) ExportSpan(sd *trace.SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, toOTLP(sd))
+	full := len(e.spans) >= otlpBatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close sends the queued spans and stops the exporter
+func (e *otlpExporter) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	return e.send()
+}
+
+func (e *otlpExporter) run() {
+	defer e.wg.Done()
+
+	t := time.NewTicker(otlpFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-t.C:
+		case <-e.flush:
+		}
+
+		if err := e.send(); err != nil {
+			logging.Default().Error("error exporting spans", "endpoint", e.endpoint, "error", err)
+		}
+	}
+}
+
+func (e *otlpExporter) send() error {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	service := e.service
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{Key: "service.name", Value: otlpValue{StringValue: &service}},
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: config.DefaultTracingService},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, msg)
+	}
+
+	return nil
+}
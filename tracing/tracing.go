@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+// Names of the spans created by the relay
+const (
+	SpanParse  = "relay.parse"
+	SpanFilter = "relay.filter"
+	SpanPost   = "relay.backend.post"
+	SpanRetry  = "relay.backend.retry"
+	SpanQueue  = "relay.backend.queue"
+	SpanBatch  = "relay.backend.batch"
+)
+
+// Exporter is a trace exporter which has to be closed
+// in order to send the spans it still holds
+type Exporter interface {
+	trace.Exporter
+	io.Closer
+}
+
+// Start registers the exporter described by the configuration
+// Nothing is sampled when no exporter is configured
+// The returned exporter is nil in this case
+func Start(cfg config.TracingConfig) (Exporter, error) {
+	var e Exporter
+
+	switch cfg.Exporter {
+	case "":
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+		return nil, nil
+
+	case config.TracingOTLP:
+		e = newOTLPExporter(cfg)
+
+	case config.TracingFile:
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e = newWriterExporter(f)
+
+	case config.TracingStdout:
+		e = newWriterExporter(nopCloser{os.Stdout})
+
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	rate := cfg.SampleRate
+	if rate == 0 {
+		rate = config.DefaultTracingRate
+	}
+
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(rate)})
+	trace.RegisterExporter(e)
+
+	return e, nil
+}
+
+// Stop unregisters the exporter and sends the remaining spans
+func Stop(e Exporter) error {
+	if e == nil {
+		return nil
+	}
+
+	trace.UnregisterExporter(e)
+	return e.Close()
+}
+
+// Detach returns a context holding the span of ctx, which is not canceled
+// with ctx, so that the backend posts outlive the client request
+func Detach(ctx context.Context) context.Context {
+	return trace.NewContext(context.Background(), trace.FromContext(ctx))
+}
+
+// SetError marks the span as failed
+func SetError(span *trace.Span, err error) {
+	span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+}
+
+// SetResponse records the outcome of a request sent to a backend,
+// the span is marked as failed on errors and 5xx responses
+func SetResponse(span *trace.Span, code int, err error) {
+	if err != nil {
+		SetError(span, err)
+		return
+	}
+
+	span.AddAttributes(trace.Int64Attribute("http.status_code", int64(code)))
+	if code/100 == 5 {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnavailable, Message: http.StatusText(code)})
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
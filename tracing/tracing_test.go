@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/config"
+)
+
+var spanData = &trace.SpanData{
+	SpanContext: trace.SpanContext{
+		TraceID: trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:  trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	},
+	ParentSpanID: trace.SpanID{0x01},
+	SpanKind:     trace.SpanKindClient,
+	Name:         SpanPost,
+	StartTime:    time.Unix(1, 0),
+	EndTime:      time.Unix(2, 0),
+	Attributes:   map[string]interface{}{"bytes": int64(42)},
+	Status:       trace.Status{Code: trace.StatusCodeUnavailable, Message: "down"},
+}
+
+func TestToOTLP(t *testing.T) {
+	s := toOTLP(spanData)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7",`+
+		`"parentSpanId":"0100000000000000","name":"relay.backend.post","kind":3,`+
+		`"startTimeUnixNano":"1000000000","endTimeUnixNano":"2000000000",`+
+		`"attributes":[{"key":"bytes","value":{"intValue":"42"}}],`+
+		`"status":{"code":2,"message":"down"}}`, string(data))
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	var header http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+	}))
+	defer s.Close()
+
+	e := newOTLPExporter(config.TracingConfig{Endpoint: s.URL, Headers: map[string]string{"X-Token": "secret"}})
+	e.ExportSpan(spanData)
+	assert.NoError(t, e.Close())
+
+	var req otlpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "secret", header.Get("X-Token"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	assert.Equal(t, config.DefaultTracingService, *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	assert.Equal(t, []otlpSpan{toOTLP(spanData)}, req.ResourceSpans[0].ScopeSpans[0].Spans)
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := newWriterExporter(nopCloser{&buf})
+	e.ExportSpan(spanData)
+	e.ExportSpan(spanData)
+	assert.NoError(t, e.Close())
+
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+}
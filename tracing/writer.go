@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"go.opencensus.io/trace"
+
+	"github.com/strike-team/influxdb-relay/logging"
+)
+
+// writerExporter writes each span as a line of JSON, using the
+// OTLP encoding of the spans, it is meant for local testing
+type writerExporter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	e  *json.Encoder
+}
+
+func newWriterExporter(w io.WriteCloser) *writerExporter {
+	return &writerExporter{w: w, e: json.NewEncoder(w)}
+}
+
+// ExportSpan writes the span
+func (e *writerExporter) ExportSpan(sd *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.e.Encode(toOTLP(sd)); err != nil {
+		logging.Default().Error("error exporting span", "error", err)
+	}
+}
+
+// Close closes the underlying writer
+func (e *writerExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.w.Close()
+}